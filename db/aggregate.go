@@ -0,0 +1,472 @@
+package db
+
+import (
+	"errors"
+	"math/bits"
+)
+
+type AggFunc uint8
+
+const (
+	AGG_COUNT AggFunc = iota
+	AGG_SUM
+	AGG_MIN
+	AGG_MAX
+	AGG_AVG
+)
+
+var (
+	ErrNotNumeric = errors.New("column value is not numeric")
+	ErrAggFunc    = errors.New("unknown aggregate function")
+)
+
+// Numeric values can be summed and averaged by Aggregate
+type Numeric interface {
+	ColumnValue
+	Float64() float64
+}
+
+// Count returns the number of IDs left in iter, iter is not advanced, nil has no IDs.
+// Value filters of one column are counted without iterating:
+// by popcount on the bitmap or by lengths of the posting lists.
+func Count(iter IDIterator) int {
+	if iter == nil {
+		return 0
+	}
+	return iter.ExactCount()
+}
+
+// walkCount counts IDs by the clone of the iterator
+func walkCount(iter IDIterator) int {
+	n := 0
+	for it := iter.Clone(); it.HasNext(); {
+		n++
+	}
+	return n
+}
+
+// density returns the part of IDs of the iterator in its range
+func density(iter IDIterator) float64 {
+	l, r := iter.Range()
+	span := float64(r) - float64(l) + 1
+	if span <= 0 {
+		return 0
+	}
+	d := float64(iter.EstimatedCardinality()) / span
+	if d > 1 {
+		d = 1
+	}
+	return d
+}
+
+// valMask is the set of values of the bitmap column, up to 256 values for use8b
+type valMask [4]uint64
+
+func maskOf(vals ...DataEntry) valMask {
+	var m valMask
+	for _, v := range vals {
+		m.add(v)
+	}
+	return m
+}
+
+// allVals returns the set of values from 0 to n-1
+func allVals(n int) valMask {
+	var m valMask
+	for i := range m {
+		switch {
+		case n >= (i+1)<<6:
+			m[i] = ^uint64(0)
+		case n > i<<6:
+			m[i] = uint64(1)<<uint(n-i<<6) - 1
+		}
+	}
+	return m
+}
+
+func (m *valMask) add(v DataEntry) {
+	if v >= 0 && v < 256 {
+		m[v>>6] |= uint64(1) << uint(v&0x3f)
+	}
+}
+
+func (m *valMask) remove(v DataEntry) {
+	if v >= 0 && v < 256 {
+		m[v>>6] &^= uint64(1) << uint(v&0x3f)
+	}
+}
+
+func (m valMask) has(v DataEntry) bool {
+	return v >= 0 && v < 256 && m[v>>6]&(uint64(1)<<uint(v&0x3f)) != 0
+}
+
+func (m valMask) isEmpty() bool {
+	return m == valMask{}
+}
+
+func (m valMask) len() int {
+	n := 0
+	for _, w := range m {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+func (m valMask) and(o valMask) valMask {
+	for i := range m {
+		m[i] &= o[i]
+	}
+	return m
+}
+
+func (m valMask) not() valMask {
+	for i := range m {
+		m[i] = ^m[i]
+	}
+	return m
+}
+
+// valueSet returns the set of values matched by the bitmap column iterator
+func (iter *ColumnIterator) valueSet() (valMask, bool) {
+	d := &iter.data
+	if d.useval {
+		return valMask{}, false
+	}
+	per, _ := d.slots()
+	all := allVals(1 << uint(64/per)) // все значения слота
+	switch {
+	case !iter.useFilter:
+		// см. Contains
+		if !d.use1b {
+			all.remove(0)
+		}
+		return all, true
+	case !iter.filterSet.isEmpty():
+		return iter.filterSet.and(all), true
+	case iter.filterVal < 0:
+		return valMask{}, false
+	case !iter.filterNEQ:
+		return maskOf(iter.filterVal).and(all), true
+	case d.use4b || d.use8b:
+		// SELECT_NEQ для 4 и 8 бит пропускает пустые значения
+		all.remove(d.empty)
+	}
+	all.remove(iter.filterVal)
+	return all, true
+}
+
+// rest returns the range of IDs not yet returned by HasNext
+func (iter *ColumnIterator) rest() (int32, int32) {
+	if iter.grow > 0 {
+		return iter.pos + 1, iter.maxpos
+	}
+	return iter.minpos, iter.pos - 1
+}
+
+// countDisjoint counts the not started merge of posting lists of different values of one column
+func (iter *MergeIterator) countDisjoint() (int, bool) {
+	if iter.currid != 0 || iter.lastJumpTo != 0 {
+		return 0, false
+	}
+	var col *Column
+	lists := make(map[interface{}]bool, len(iter.iterators))
+	n := 0
+	for _, it := range iter.iterators {
+		switch ri := it.(type) {
+		case nil:
+		case *RangeIterator:
+			if ri.col == nil || (col != nil && ri.col != col) {
+				return 0, false
+			}
+			col = ri.col
+			if ri.maxpos < 0 {
+				continue
+			}
+			// одно и то же значение дважды
+			if lists[&ri.filter[0]] {
+				return 0, false
+			}
+			lists[&ri.filter[0]] = true
+			// итераторы уже сдвинуты на первый ID при создании MergeIterator
+			if ri.pos >= ri.minpos && ri.pos <= ri.maxpos {
+				if ri.grow > 0 {
+					n += int(ri.maxpos - ri.pos + 1)
+				} else {
+					n += int(ri.pos - ri.minpos + 1)
+				}
+			}
+		case *RoaringIterator:
+			if ri.col == nil || (col != nil && ri.col != col) || lists[ri.bm] {
+				return 0, false
+			}
+			col = ri.col
+			lists[ri.bm] = true
+			if !ri.done {
+				n += ri.ExactCount() + 1
+			}
+		default:
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// spread2 places the lower 32 bits of x to the even bits
+func spread2(x uint64) uint64 {
+	x &= 0xffffffff
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// spread4 places the lower 16 bits of x to every fourth bit
+func spread4(x uint64) uint64 {
+	x &= 0xffff
+	x = (x | x<<24) & 0x000000ff000000ff
+	x = (x | x<<12) & 0x000f000f000f000f
+	x = (x | x<<6) & 0x0303030303030303
+	x = (x | x<<3) & 0x1111111111111111
+	return x
+}
+
+// spread8 places the lower 8 bits of x to the lowest bits of bytes
+func spread8(x uint64) uint64 {
+	x &= 0xff
+	x = (x | x<<28) & 0x0000000f0000000f
+	x = (x | x<<14) & 0x0003000300030003
+	x = (x | x<<7) & 0x0101010101010101
+	return x
+}
+
+// slots returns the number of IDs in one word of the bitmap and the mask of the lowest bits of their slots
+func (c *colData) slots() (int32, uint64) {
+	switch {
+	case c.use1b:
+		return 64, 0xffffffffffffffff
+	case c.use2b:
+		return 32, 0x5555555555555555
+	case c.use8b:
+		return 8, 0x0101010101010101
+	}
+	return 16, 0x1111111111111111
+}
+
+// matchSlots returns the lowest bits of slots of the bitmap word having values from set
+func matchSlots(word uint64, set valMask, per int32, ones uint64) uint64 {
+	if per == 8 && set.len() > 128 {
+		// для большого набора быстрее найти слоты с остальными значениями
+		return ^matchSlots(word, set.not(), per, ones) & ones
+	}
+	var match uint64
+	for i, m := range set {
+		for ; m != 0; m &= m - 1 {
+			v := uint64(i<<6 + bits.TrailingZeros64(m))
+			x := word ^ (v * ones)
+			switch per {
+			case 64:
+				match |= ^x
+			case 32:
+				match |= ^(x | x>>1) & ones
+			case 16:
+				x |= x >> 1
+				x |= x >> 2
+				match |= ^x & ones
+			default:
+				// старший бит байта установлен, если байт не нулевой, без переносов между байтами
+				x |= (x & 0x7f7f7f7f7f7f7f7f) + 0x7f7f7f7f7f7f7f7f
+				match |= ^x >> 7 & ones
+			}
+		}
+	}
+	return match
+}
+
+// countVals counts not deleted IDs from lo to hi having values from set, only for use1b, use2b, use4b, use8b
+func (c *colData) countVals(set valMask, lo, hi int32) int {
+	if lo < 0 {
+		lo = 0
+	}
+	per, ones := c.slots()
+	if last := c.bmp.len()*per - 1; hi > last {
+		hi = last
+	}
+	n := 0
+	for w := lo / per; w <= hi/per && lo <= hi; w++ {
+		match := matchSlots(c.bmp.word(w), set, per, ones)
+
+		// биты ID слова в границах lo..hi и не удаленных
+		first := w * per
+		idm := uint64(0xffffffffffffffff) >> uint(64-per)
+		if lo > first {
+			idm &^= uint64(1)<<uint(lo-first) - 1
+		}
+		if hi < first+per-1 {
+			idm &= uint64(1)<<uint(hi-first+1) - 1
+		}
+		idm &^= c.del.word(first>>6) >> uint(first&0x3f)
+		switch per {
+		case 32:
+			idm = spread2(idm)
+		case 16:
+			idm = spread4(idm)
+		case 8:
+			idm = spread8(idm)
+		}
+		n += bits.OnesCount64(match & idm)
+	}
+	return n
+}
+
+// countEach counts not deleted IDs from lo to hi by their values in one pass over the words, only for use4b and use8b
+func (c *colData) countEach(lo, hi int32) *[256]int {
+	var ret [256]int
+	if lo < 0 {
+		lo = 0
+	}
+	per, _ := c.slots()
+	if last := c.bmp.len()*per - 1; hi > last {
+		hi = last
+	}
+	width := uint(64 / per)
+	vmask := uint64(1)<<width - 1
+	for w := lo / per; w <= hi/per && lo <= hi; w++ {
+		word := c.bmp.word(w)
+		first := w * per
+		from, to := int32(0), per-1
+		if lo > first {
+			from = lo - first
+		}
+		if hi < first+per-1 {
+			to = hi - first
+		}
+		del := c.del.word(first>>6) >> uint(first&0x3f)
+		for i := from; i <= to; i++ {
+			if del&(uint64(1)<<uint(i)) == 0 {
+				ret[word>>(uint(i)*width)&vmask]++
+			}
+		}
+	}
+	return &ret
+}
+
+// tally counts not empty values of the column for IDs left in iter, iter is not advanced
+func (c *Column) tally(iter IDIterator) map[DataEntry]int {
+	ret := make(map[DataEntry]int)
+	if iter == nil {
+		return ret
+	}
+	if it, ok := iter.(*ColumnIterator); ok && it.col == c {
+		if set, ok := it.valueSet(); ok {
+			lo, hi := it.rest()
+			var counts *[256]int
+			if it.data.use4b || it.data.use8b {
+				counts = it.data.countEach(lo, hi)
+			}
+			for v := DataEntry(0); v < 256; v++ {
+				if !set.has(v) || v == it.data.empty {
+					continue
+				}
+				n := 0
+				if counts != nil {
+					n = counts[v]
+				} else {
+					// для 1b и 2b подсчет по каждому значению быстрее разбора слотов
+					n = it.data.countVals(maskOf(v), lo, hi)
+				}
+				if n > 0 {
+					ret[v] = n
+				}
+			}
+			return ret
+		}
+	}
+
+	c.RLock()
+	data := c.view()
+	maxId := c.maxId
+	c.RUnlock()
+
+	for it := iter.Clone(); it.HasNext(); {
+		id := it.NextID()
+		if id > maxId {
+			continue
+		}
+		if v := data.Get(id); v != NullEntry && v != data.empty {
+			ret[v]++
+		}
+	}
+	return ret
+}
+
+// Aggregate calculates fn over not empty values of the column for IDs left in iter, iter is not advanced.
+// Count and Sum of nothing are zero IntValue, Min, Max and Avg of nothing are nil.
+// Sum is IntValue for IntValue columns, otherwise FloatValue, Avg is always FloatValue.
+func (dt *DataTable) Aggregate(iter IDIterator, colname string, fn AggFunc) (ColumnValue, error) {
+	col, err := dt.column(colname)
+	if err != nil {
+		return nil, err
+	}
+	return col.aggregate(col.tally(iter), fn)
+}
+
+// aggregate calculates fn by counts of values
+func (c *Column) aggregate(counts map[DataEntry]int, fn AggFunc) (ColumnValue, error) {
+	switch fn {
+	case AGG_COUNT:
+		n := 0
+		for _, cnt := range counts {
+			n += cnt
+		}
+		return IntValue(n), nil
+
+	case AGG_MIN, AGG_MAX:
+		var ret ColumnValue
+		for v := range counts {
+			cv := c.FromDictonary(v)
+			if ret == nil {
+				ret = cv
+				continue
+			}
+			cmp := cv.Compare(ret)
+			if (fn == AGG_MIN && cmp < 0) || (fn == AGG_MAX && cmp > 0) {
+				ret = cv
+			}
+		}
+		return ret, nil
+
+	case AGG_SUM, AGG_AVG:
+	default:
+		return nil, ErrAggFunc
+	}
+
+	// каждое значение словаря читаем один раз
+	var isum int64
+	var fsum float64
+	isfloat := false
+	n := 0
+	for v, cnt := range counts {
+		switch cv := c.FromDictonary(v).(type) {
+		case IntValue:
+			isum += int64(cv) * int64(cnt)
+		case Numeric:
+			fsum += cv.Float64() * float64(cnt)
+			isfloat = true
+		default:
+			return nil, ErrNotNumeric
+		}
+		n += cnt
+	}
+	if fn == AGG_AVG {
+		if n == 0 {
+			return nil, nil
+		}
+		return FloatValue((fsum + float64(isum)) / float64(n)), nil
+	}
+	if isfloat {
+		return FloatValue(fsum + float64(isum)), nil
+	}
+	return IntValue(isum), nil
+}
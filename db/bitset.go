@@ -0,0 +1,410 @@
+package db
+
+import "math/bits"
+
+// pack2 places the even bits of x to the lower 32 bits
+func pack2(x uint64) uint64 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x>>4) & 0x00ff00ff00ff00ff
+	x = (x | x>>8) & 0x0000ffff0000ffff
+	x = (x | x>>16) & 0x00000000ffffffff
+	return x
+}
+
+// pack4 places every fourth bit of x to the lower 16 bits
+func pack4(x uint64) uint64 {
+	x &= 0x1111111111111111
+	x = (x | x>>3) & 0x0303030303030303
+	x = (x | x>>6) & 0x000f000f000f000f
+	x = (x | x>>12) & 0x000000ff000000ff
+	x = (x | x>>24) & 0x000000000000ffff
+	return x
+}
+
+// pack8 places the lowest bits of bytes of x to the lower 8 bits
+func pack8(x uint64) uint64 {
+	x &= 0x0101010101010101
+	x = (x | x>>7) & 0x0003000300030003
+	x = (x | x>>14) & 0x0000000f0000000f
+	x = (x | x>>28) & 0x00000000000000ff
+	return x
+}
+
+// fillBits sets bits of not deleted IDs from lo to hi having values from set, only for use1b, use2b, use4b, use8b.
+// Bit i of dst[k] is ID (base+k)*64+i, other bits of dst are cleared.
+func (c *colData) fillBits(dst []uint64, base int32, set valMask, lo, hi int32) {
+	for i := range dst {
+		dst[i] = 0
+	}
+	per, ones := c.slots()
+	if last := c.bmp.len()*per - 1; hi > last {
+		hi = last
+	}
+	if lo < 0 {
+		lo = 0
+	}
+	// слов биткарты на 64 ID
+	n := 64 / per
+	for k := lo >> 6; k <= hi>>6 && lo <= hi; k++ {
+		var w uint64
+		for j := int32(0); j < n; j++ {
+			bi := k*n + j
+			if bi >= c.bmp.len() {
+				break
+			}
+			match := matchSlots(c.bmp.word(bi), set, per, ones)
+			switch per {
+			case 32:
+				match = pack2(match)
+			case 16:
+				match = pack4(match)
+			case 8:
+				match = pack8(match)
+			}
+			w |= match << uint(j*per)
+		}
+		w &^= c.del.word(k)
+		if k == lo>>6 {
+			w &= ^uint64(0) << uint(lo&0x3f)
+		}
+		if k == hi>>6 {
+			w &= ^uint64(0) >> uint(63-hi&0x3f)
+		}
+		dst[k-base] = w
+	}
+}
+
+// BitsetIterator returns IDs of the bitset made by And, Or and Sub of bitmap columns
+type BitsetIterator struct {
+	words      []uint64 // бит i слова k - ID (base+k)*64+i
+	base       int32
+	pos        int32
+	grow       int32
+	min, max   int32 // первый и последний ID, min > max для пустого набора
+	n          int
+	lastJumpTo IDEntry
+	lastJumpOk bool
+}
+
+func newBitsetIterator(words []uint64, base int32, reversed bool) *BitsetIterator {
+	ret := &BitsetIterator{words: words, base: base, grow: 1, min: 0, max: -1}
+	for _, w := range words {
+		ret.n += bits.OnesCount64(w)
+	}
+	if ret.n > 0 {
+		ret.min = ret.next(base << 6)
+		ret.max = ret.prev((base+int32(len(words)))<<6 - 1)
+	}
+	ret.pos = ret.min - 1
+	if reversed {
+		ret.grow = -1
+		ret.pos = ret.max + 1
+	}
+	return ret
+}
+
+// next returns the least ID of the bitset not less than from, -1 if there is no such ID
+func (iter *BitsetIterator) next(from int32) int32 {
+	k := from>>6 - iter.base
+	mask := ^uint64(0) << uint(from&0x3f)
+	if k < 0 {
+		k, mask = 0, ^uint64(0)
+	}
+	for ; int(k) < len(iter.words); k++ {
+		if w := iter.words[k] & mask; w != 0 {
+			return (iter.base+k)<<6 + int32(bits.TrailingZeros64(w))
+		}
+		mask = ^uint64(0)
+	}
+	return -1
+}
+
+// prev returns the greatest ID of the bitset not greater than from, -1 if there is no such ID
+func (iter *BitsetIterator) prev(from int32) int32 {
+	if from < 0 {
+		return -1
+	}
+	k := from>>6 - iter.base
+	mask := ^uint64(0) >> uint(63-from&0x3f)
+	if int(k) >= len(iter.words) {
+		k, mask = int32(len(iter.words))-1, ^uint64(0)
+	}
+	for ; k >= 0; k-- {
+		if w := iter.words[k] & mask; w != 0 {
+			return (iter.base+k)<<6 + 63 - int32(bits.LeadingZeros64(w))
+		}
+		mask = ^uint64(0)
+	}
+	return -1
+}
+
+func (iter *BitsetIterator) Clone() IDIterator {
+	rv := &BitsetIterator{}
+	*rv = *iter
+	return rv
+}
+
+func (iter *BitsetIterator) Cardinality() int32 {
+	return int32(iter.n)
+}
+
+func (iter *BitsetIterator) EstimatedCardinality() int {
+	return iter.n
+}
+
+// ExactCount popcounts the words after the current position
+func (iter *BitsetIterator) ExactCount() int {
+	lo, hi := iter.rest()
+	if lo > hi {
+		return 0
+	}
+	if lo == iter.min && hi == iter.max {
+		return iter.n
+	}
+	n := 0
+	for k := lo >> 6; k <= hi>>6; k++ {
+		w := iter.words[k-iter.base]
+		if k == lo>>6 {
+			w &= ^uint64(0) << uint(lo&0x3f)
+		}
+		if k == hi>>6 {
+			w &= ^uint64(0) >> uint(63-hi&0x3f)
+		}
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// rest returns the range of IDs not yet returned by HasNext
+func (iter *BitsetIterator) rest() (int32, int32) {
+	lo, hi := iter.min, iter.max
+	if iter.grow > 0 && iter.pos >= lo {
+		lo = iter.pos + 1
+	}
+	if iter.grow < 0 && iter.pos <= hi {
+		hi = iter.pos - 1
+	}
+	return lo, hi
+}
+
+func (iter *BitsetIterator) Reversed() bool {
+	return iter.grow < 0
+}
+
+func (iter *BitsetIterator) Range() (IDEntry, IDEntry) {
+	if iter.n == 0 {
+		return 0, 0
+	}
+	return IDEntry(iter.min), IDEntry(iter.max)
+}
+
+// JumpTo moves to the least ID not less than id, or the greatest one not greater than id for the reversed iterator
+func (iter *BitsetIterator) JumpTo(id IDEntry) bool {
+	if iter.lastJumpTo == id {
+		return iter.lastJumpOk
+	}
+	iter.lastJumpTo = id
+	if iter.n == 0 {
+		iter.lastJumpOk = false
+		return false
+	}
+	to := int32(id)
+	if id > 0x7fffffff {
+		to = iter.max + 1
+	}
+	iter.pos = to - iter.grow
+	iter.lastJumpOk = iter.HasNext()
+	return iter.lastJumpOk
+}
+
+func (iter *BitsetIterator) HasNext() bool {
+	if iter.grow > 0 {
+		if iter.pos > iter.max {
+			return false
+		}
+		if iter.pos = iter.next(iter.pos + 1); iter.pos < 0 {
+			iter.pos = iter.max + 1
+			return false
+		}
+		return true
+	}
+	if iter.pos < iter.min {
+		return false
+	}
+	if iter.pos = iter.prev(iter.pos - 1); iter.pos < 0 {
+		iter.pos = iter.min - 1
+		return false
+	}
+	return true
+}
+
+func (iter *BitsetIterator) NextID() IDEntry {
+	if iter.pos >= iter.min && iter.pos <= iter.max {
+		return IDEntry(iter.pos)
+	}
+	return 0
+}
+
+// bitsRange returns the range of IDs not yet returned by the iterator of bitmap column or bitset
+func bitsRange(it IDIterator) (int32, int32, bool) {
+	switch it := it.(type) {
+	case *ColumnIterator:
+		if _, ok := it.valueSet(); ok {
+			lo, hi := it.rest()
+			return lo, hi, true
+		}
+	case *BitsetIterator:
+		lo, hi := it.rest()
+		return lo, hi, true
+	}
+	return 0, 0, false
+}
+
+// bitsOf writes IDs of the iterator from lo to hi, not yet returned, to dst like fillBits
+func bitsOf(it IDIterator, dst []uint64, base, lo, hi int32) {
+	rl, rh, _ := bitsRange(it)
+	if lo < rl {
+		lo = rl
+	}
+	if hi > rh {
+		hi = rh
+	}
+	switch it := it.(type) {
+	case *ColumnIterator:
+		set, _ := it.valueSet()
+		it.data.fillBits(dst, base, set, lo, hi)
+	case *BitsetIterator:
+		for i := range dst {
+			dst[i] = 0
+		}
+		for k := lo >> 6; k <= hi>>6 && lo <= hi; k++ {
+			w := it.words[k-it.base]
+			if k == lo>>6 {
+				w &= ^uint64(0) << uint(lo&0x3f)
+			}
+			if k == hi>>6 {
+				w &= ^uint64(0) >> uint(63-hi&0x3f)
+			}
+			dst[k-base] = w
+		}
+	}
+}
+
+// combineBits replaces iterators of bitmap columns and bitsets by one bitset,
+// which is made by word-wise intersection (and) or union of their IDs.
+// The intersection is left to JumpTo, if another iterator has less IDs than the words of the bitset.
+func combineBits(iters []IDIterator, and bool) []IDIterator {
+	if len(iters) < 2 {
+		return iters
+	}
+	reversed := iters[0].Reversed()
+	var bitIters, other []IDIterator
+	var lo, hi int32
+	for _, it := range iters {
+		l, h, ok := bitsRange(it)
+		if !ok || it.Reversed() != reversed {
+			other = append(other, it)
+			continue
+		}
+		switch {
+		case len(bitIters) == 0:
+			lo, hi = l, h
+		case and:
+			lo, hi = max32(lo, l), min32(hi, h)
+		default:
+			lo, hi = min32(lo, l), max32(hi, h)
+		}
+		bitIters = append(bitIters, it)
+	}
+	if len(bitIters) < 2 {
+		return iters
+	}
+	if and {
+		for _, it := range other {
+			if it == nil {
+				continue
+			}
+			l, h := it.Range()
+			lo, hi = max32(lo, int32(l)), min32(hi, int32(h))
+			if lo <= hi && it.EstimatedCardinality() < int(hi>>6-lo>>6+1) {
+				return iters
+			}
+		}
+	}
+	if lo > hi {
+		return append(other, newBitsetIterator(nil, 0, reversed))
+	}
+
+	base := lo >> 6
+	words := make([]uint64, hi>>6-base+1)
+	tmp := make([]uint64, len(words))
+	bitsOf(bitIters[0], words, base, lo, hi)
+	for _, it := range bitIters[1:] {
+		bitsOf(it, tmp, base, lo, hi)
+		if and {
+			for i, w := range tmp {
+				words[i] &= w
+			}
+		} else {
+			for i, w := range tmp {
+				words[i] |= w
+			}
+		}
+	}
+	return append(other, newBitsetIterator(words, base, reversed))
+}
+
+// subBits subtracts iterators of bitmap columns and bitsets from iter of the same kind word-wise,
+// returns the bitset and other diffs
+func subBits(iter IDIterator, diffs []IDIterator) (IDIterator, []IDIterator, bool) {
+	base := iter
+	if isec, ok := iter.(*IntersectIterator); ok && len(isec.iterators) == 1 && len(isec.iterdiffs) == 0 {
+		base = isec.iterators[0]
+	}
+	lo, hi, ok := bitsRange(base)
+	if !ok {
+		return iter, diffs, false
+	}
+	var bitDiffs, other []IDIterator
+	for _, it := range diffs {
+		if _, _, ok := bitsRange(it); ok && it.Reversed() == base.Reversed() {
+			bitDiffs = append(bitDiffs, it)
+		} else {
+			other = append(other, it)
+		}
+	}
+	if len(bitDiffs) == 0 {
+		return iter, diffs, false
+	}
+	if lo > hi {
+		return newBitsetIterator(nil, 0, base.Reversed()), other, true
+	}
+
+	b := lo >> 6
+	words := make([]uint64, hi>>6-b+1)
+	tmp := make([]uint64, len(words))
+	bitsOf(base, words, b, lo, hi)
+	for _, it := range bitDiffs {
+		bitsOf(it, tmp, b, lo, hi)
+		for i, w := range tmp {
+			words[i] &^= w
+		}
+	}
+	return newBitsetIterator(words, b, base.Reversed()), other, true
+}
+
+func min32(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
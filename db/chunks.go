@@ -0,0 +1,104 @@
+package db
+
+const (
+	chunkBits  = 10
+	chunkWords = 1 << chunkBits // слов в куске биткарты
+)
+
+type chunk struct {
+	epoch uint64 // кусок меняется на месте только в своей эпохе, иначе копируется
+	words []uint64
+}
+
+// chunks is the growable bitmap stored by chunks of chunkWords words, only the last chunk may be shorter.
+// The bitmap grows by chunks without copying all words, and the writer copies only chunks it changes,
+// when the bitmap is given to iterators.
+type chunks []chunk
+
+// newChunks allocates the bitmap of n zero words
+func newChunks(n int, epoch uint64) chunks {
+	ret := make(chunks, 0, (n+chunkWords-1)>>chunkBits)
+	for ; n > 0; n -= chunkWords {
+		ln := n
+		if ln > chunkWords {
+			ln = chunkWords
+		}
+		ret = append(ret, chunk{epoch: epoch, words: make([]uint64, ln)})
+	}
+	return ret
+}
+
+// chunksOf splits words to chunks without copying
+func chunksOf(words []uint64, epoch uint64) chunks {
+	ret := make(chunks, 0, (len(words)+chunkWords-1)>>chunkBits)
+	for i := 0; i < len(words); i += chunkWords {
+		j := i + chunkWords
+		if j > len(words) {
+			j = len(words)
+		}
+		ret = append(ret, chunk{epoch: epoch, words: words[i:j:j]})
+	}
+	return ret
+}
+
+// len returns the number of words
+func (b chunks) len() int32 {
+	if len(b) == 0 {
+		return 0
+	}
+	return int32(len(b)-1)<<chunkBits + int32(len(b[len(b)-1].words))
+}
+
+// word returns the word w, zero beyond the bitmap
+func (b chunks) word(w int32) uint64 {
+	k, i := int(w>>chunkBits), int(w&(chunkWords-1))
+	if w < 0 || k >= len(b) || i >= len(b[k].words) {
+		return 0
+	}
+	return b[k].words[i]
+}
+
+// isSet reports whether the bit n is set
+func (b chunks) isSet(n uint32) bool {
+	return b.word(int32(n>>6))&(uint64(1)<<(n&0x3f)) != 0
+}
+
+// at returns the word w for writing, the bitmap is grown by zero words.
+// The chunk of another epoch is copied, the list of chunks must be owned by the writer.
+func (b *chunks) at(w int32, epoch uint64) *uint64 {
+	k, i := int(w>>chunkBits), int(w&(chunkWords-1))
+	for len(*b) <= k {
+		if n := len(*b); n > 0 {
+			(*b)[n-1].grow(chunkWords)
+		}
+		*b = append(*b, chunk{epoch: epoch})
+	}
+	ch := &(*b)[k]
+	ch.grow(i + 1)
+	if ch.epoch != epoch {
+		ch.words = append(make([]uint64, 0, cap(ch.words)), ch.words...)
+		ch.epoch = epoch
+	}
+	return &ch.words[i]
+}
+
+// setRange sets bits from lo to hi, the bitmap is grown like at
+func (b *chunks) setRange(lo, hi uint32, epoch uint64) {
+	for w := lo >> 6; w <= hi>>6; w++ {
+		mask := ^uint64(0)
+		if w == lo>>6 {
+			mask &= ^uint64(0) << (lo & 0x3f)
+		}
+		if w == hi>>6 {
+			mask &= ^uint64(0) >> (63 - hi&0x3f)
+		}
+		*b.at(int32(w), epoch) |= mask
+	}
+}
+
+// grow appends zero words up to n, words before len are not changed, so iterators still read them
+func (ch *chunk) grow(n int) {
+	if len(ch.words) < n {
+		ch.words = append(ch.words, make([]uint64, n-len(ch.words))...)
+	}
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// ValueCodec encodes values of one type into binary form, e.g. for snapshots and WAL.
+// User types can be registered by RegisterCodec with tags from MinUserCodecTag.
+type ValueCodec interface {
+	Tag() byte
+	AppendValue(dst []byte, v ColumnValue) []byte
+	DecodeValue(src []byte) (ColumnValue, error)
+}
+
+const (
+	gobCodecTag byte = iota // незарегистрированные типы кодируются через encoding/gob
+	intCodecTag
+	floatCodecTag
+	stringCodecTag
+	boolCodecTag
+	bytesCodecTag
+	timeCodecTag
+)
+
+// MinUserCodecTag is the first tag for user codecs, lesser tags are reserved
+const MinUserCodecTag byte = 32
+
+var (
+	ErrCodecTag     = errors.New("codec tag is reserved or already registered")
+	ErrCodecType    = errors.New("value type already has a codec")
+	ErrUnknownCodec = errors.New("unknown codec tag")
+	ErrValueFormat  = errors.New("invalid value encoding")
+)
+
+type codecRegistry struct {
+	sync.RWMutex
+	types map[reflect.Type]ValueCodec
+	tags  [256]ValueCodec
+}
+
+var codecs = &codecRegistry{
+	types: make(map[reflect.Type]ValueCodec),
+}
+
+func (cr *codecRegistry) register(sample ColumnValue, c ValueCodec) {
+	cr.types[reflect.TypeOf(sample)] = c
+	cr.tags[c.Tag()] = c
+}
+
+func init() {
+	codecs.register(IntValue(0), intCodec{})
+	codecs.register(FloatValue(0), floatCodec{})
+	codecs.register(StringValue(""), stringCodec{})
+	codecs.register(BoolValue(false), boolCodec{})
+	codecs.register(BytesValue(""), bytesCodec{})
+	codecs.register(TimeValue(0), timeCodec{})
+}
+
+// RegisterCodec registers codec for the type of sample value.
+// The codec of a type can't be replaced, otherwise new records would be encoded by another tag.
+func RegisterCodec(sample ColumnValue, c ValueCodec) error {
+	if c.Tag() < MinUserCodecTag {
+		return ErrCodecTag
+	}
+	codecs.Lock()
+	defer codecs.Unlock()
+	if codecs.tags[c.Tag()] != nil {
+		return ErrCodecTag
+	}
+	if _, ok := codecs.types[reflect.TypeOf(sample)]; ok {
+		return ErrCodecType
+	}
+	codecs.register(sample, c)
+	return nil
+}
+
+// CodecOf returns registered codec for the type of v
+func CodecOf(v ColumnValue) (ValueCodec, bool) {
+	codecs.RLock()
+	c, ok := codecs.types[reflect.TypeOf(v)]
+	codecs.RUnlock()
+	return c, ok
+}
+
+// AppendValue appends tag and encoded value to dst, e.g. to get bytes for hashing.
+// Values without registered codec are encoded by encoding/gob, their types must be registered by gob.Register.
+func AppendValue(dst []byte, v ColumnValue) ([]byte, error) {
+	if c, ok := CodecOf(v); ok {
+		return c.AppendValue(append(dst, c.Tag()), v), nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return dst, err
+	}
+	return append(append(dst, gobCodecTag), buf.Bytes()...), nil
+}
+
+// DecodeValue decodes value encoded by AppendValue
+func DecodeValue(src []byte) (ColumnValue, error) {
+	if len(src) == 0 {
+		return nil, ErrValueFormat
+	}
+	if src[0] == gobCodecTag {
+		var v ColumnValue
+		if err := gob.NewDecoder(bytes.NewReader(src[1:])).Decode(&v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	codecs.RLock()
+	c := codecs.tags[src[0]]
+	codecs.RUnlock()
+	if c == nil {
+		return nil, ErrUnknownCodec
+	}
+	return c.DecodeValue(src[1:])
+}
+
+type intCodec struct{}
+
+func (intCodec) Tag() byte { return intCodecTag }
+func (intCodec) AppendValue(dst []byte, v ColumnValue) []byte {
+	return binary.AppendVarint(dst, int64(v.(IntValue)))
+}
+func (intCodec) DecodeValue(src []byte) (ColumnValue, error) {
+	v, n := binary.Varint(src)
+	if n <= 0 || n != len(src) {
+		return nil, ErrValueFormat
+	}
+	return IntValue(v), nil
+}
+
+type floatCodec struct{}
+
+func (floatCodec) Tag() byte { return floatCodecTag }
+func (floatCodec) AppendValue(dst []byte, v ColumnValue) []byte {
+	return binary.LittleEndian.AppendUint64(dst, math.Float64bits(float64(v.(FloatValue))))
+}
+func (floatCodec) DecodeValue(src []byte) (ColumnValue, error) {
+	if len(src) != 8 {
+		return nil, ErrValueFormat
+	}
+	return FloatValue(math.Float64frombits(binary.LittleEndian.Uint64(src))), nil
+}
+
+type stringCodec struct{}
+
+func (stringCodec) Tag() byte { return stringCodecTag }
+func (stringCodec) AppendValue(dst []byte, v ColumnValue) []byte {
+	return append(dst, v.(StringValue)...)
+}
+func (stringCodec) DecodeValue(src []byte) (ColumnValue, error) {
+	return StringValue(src), nil
+}
+
+type boolCodec struct{}
+
+func (boolCodec) Tag() byte { return boolCodecTag }
+func (boolCodec) AppendValue(dst []byte, v ColumnValue) []byte {
+	if v.(BoolValue) {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+func (boolCodec) DecodeValue(src []byte) (ColumnValue, error) {
+	if len(src) != 1 || src[0] > 1 {
+		return nil, ErrValueFormat
+	}
+	return BoolValue(src[0] == 1), nil
+}
+
+type bytesCodec struct{}
+
+func (bytesCodec) Tag() byte { return bytesCodecTag }
+func (bytesCodec) AppendValue(dst []byte, v ColumnValue) []byte {
+	return append(dst, v.(BytesValue)...)
+}
+func (bytesCodec) DecodeValue(src []byte) (ColumnValue, error) {
+	return BytesValue(src), nil
+}
+
+type timeCodec struct{}
+
+func (timeCodec) Tag() byte { return timeCodecTag }
+func (timeCodec) AppendValue(dst []byte, v ColumnValue) []byte {
+	return binary.AppendVarint(dst, int64(v.(TimeValue)))
+}
+func (timeCodec) DecodeValue(src []byte) (ColumnValue, error) {
+	v, n := binary.Varint(src)
+	if n <= 0 || n != len(src) {
+		return nil, ErrValueFormat
+	}
+	return TimeValue(v), nil
+}
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"math/bits"
 	"sort"
+	"sync/atomic"
 )
 
 type IDIterator interface {
@@ -9,39 +11,69 @@ type IDIterator interface {
 	NextID() IDEntry
 	JumpTo(IDEntry) bool // результат как у HasNext
 	Range() (IDEntry, IDEntry)
-	Cardinality() int32
+	Cardinality() int32        // быстрая оценка без обхода, не граница (у ColumnIterator - по счетчикам значений), по ней упорядочиваются итераторы в And и Or
+	EstimatedCardinality() int // оценка количества ID без обхода
+	ExactCount() int           // количество еще не возвращенных ID, итератор не сдвигается
 	Reversed() bool
 	Clone() IDIterator
 }
 
+// Iterator must be called under the column read lock, the iterator doesn't need it later
 func (c *Column) Iterator(reverse bool, useFilter bool, filterVal DataEntry, filterNEQ bool) *ColumnIterator {
-	if reverse {
-		return &ColumnIterator{
-			pos:       int32(c.maxId) + 1,
-			grow:      -1,
-			col:       c,
-			use1b:     c.use1b,
-			use2b:     c.use2b,
-			maxpos:    int32(c.maxId),
-			minpos:    int32(c.minId),
-			useFilter: useFilter,
-			filterVal: filterVal,
-			filterNEQ: filterNEQ,
-		}
-	}
-	return &ColumnIterator{
+	ret := &ColumnIterator{
 		pos:       int32(c.minId) - 1,
 		grow:      1,
 		col:       c,
-		use1b:     c.use1b,
-		use2b:     c.use2b,
+		data:      c.view(),
 		maxpos:    int32(c.maxId),
 		minpos:    int32(c.minId),
 		useFilter: useFilter,
 		filterVal: filterVal,
 		filterNEQ: filterNEQ,
 	}
+	if reverse {
+		ret.pos = int32(c.maxId) + 1
+		ret.grow = -1
+	}
+	ret.card = c.estimate(ret)
+	return ret
+}
 
+// estimate returns the number of IDs of the iterator by the value counts of the column
+func (c *Column) estimate(iter *ColumnIterator) int32 {
+	span := iter.maxpos - iter.minpos + 1
+	if span < 0 {
+		span = 0
+	}
+	if !iter.useFilter {
+		return span
+	}
+	n := 0
+	switch {
+	case !iter.filterSet.isEmpty():
+		for v := DataEntry(0); v < 256; v++ {
+			if iter.filterSet.has(v) {
+				n += c.countOf(v)
+			}
+		}
+	case !iter.filterNEQ:
+		n = c.countOf(iter.filterVal)
+	case c.use1b || c.use2b:
+		// пустые значения тоже подходят
+		n = c.rows() - c.countOf(iter.filterVal)
+	default:
+		n = int(span) - c.countOf(iter.filterVal)
+		if iter.filterVal != c.empty {
+			n -= c.countOf(c.empty)
+		}
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n > int(span) {
+		n = int(span)
+	}
+	return int32(n)
 }
 
 // filter должен быть отсортирован по возрастанию
@@ -90,17 +122,56 @@ func NewIteratorByIds(filter []IDEntry, reverse bool) IDIterator {
 }
 
 func (c *Column) IteratorWithFilterVal(filter DataEntry, reverse, noneq bool) (ret IDIterator) {
-	if c.use1b || c.use2b || c.use4b || noneq {
+	if c.use1b || c.use2b || c.use4b || c.use8b || noneq {
 		ret = c.Iterator(reverse, true, filter, noneq)
+	} else if ve := c.posting(filter); ve != nil && ve.bm != nil {
+		// список не меняется на месте после смены эпохи
+		atomic.AddUint64(&c.epoch, 1)
+		ret = newRoaringIterator(c, ve.bm, reverse)
+	} else if ve != nil {
+		ret = c.IteratorWithFilterId(ve.ids, reverse)
 	} else {
-		ids := c.GetV(filter)
-		ret = c.IteratorWithFilterId(ids, reverse)
+		ret = c.IteratorWithFilterId(nil, reverse)
 	}
 
 	return ret
 }
 
-// TODO: gte/lte iterators
+// IteratorWithFilterVals returns iterator of IDs having any of the filter values.
+// Zero (empty) value is skipped. Returns nil, if there are no such IDs.
+func (c *Column) IteratorWithFilterVals(filter []DataEntry, reverse bool) IDIterator {
+	if c.use1b || c.use2b || c.use4b || c.use8b {
+		// значений не больше 256 - фильтруем маской за один проход по биткарте
+		var set valMask
+		for _, v := range filter {
+			if v != c.empty && c.hasVal(v) {
+				set.add(v)
+			}
+		}
+		if set.isEmpty() {
+			return nil
+		}
+		ret := c.Iterator(reverse, true, 0, false)
+		ret.filterSet = set
+		ret.card = c.estimate(ret)
+		return ret
+	}
+
+	iters := make([]IDIterator, 0, len(filter))
+	for _, v := range filter {
+		if v == c.empty || !c.hasVal(v) {
+			continue
+		}
+		iters = append(iters, c.IteratorWithFilterVal(v, reverse, false))
+	}
+	switch len(iters) {
+	case 0:
+		return nil
+	case 1:
+		return iters[0]
+	}
+	return NewIteratorMerge(iters...)
+}
 
 type ColumnIterator struct {
 	pos        int32
@@ -108,11 +179,12 @@ type ColumnIterator struct {
 	maxpos     int32
 	minpos     int32
 	col        *Column
-	use1b      bool
-	use2b      bool
+	data       colData // снимок данных колонки на момент создания итератора
 	useFilter  bool
 	filterVal  DataEntry
 	filterNEQ  bool
+	filterSet  valMask // допустимые значения для use1b, use2b, use4b, use8b
+	card       int32   // оценка количества ID по статистике значений колонки
 	lastJumpTo IDEntry
 	lastJumpOk bool
 }
@@ -124,7 +196,21 @@ func (iter *ColumnIterator) Clone() IDIterator {
 }
 
 func (iter *ColumnIterator) Cardinality() int32 {
-	return iter.maxpos - iter.minpos + 1
+	return iter.card
+}
+
+// EstimatedCardinality returns the number of IDs by the value counts of the column
+func (iter *ColumnIterator) EstimatedCardinality() int {
+	return int(iter.card)
+}
+
+// ExactCount popcounts the bitmap for the value filter, otherwise walks the clone
+func (iter *ColumnIterator) ExactCount() int {
+	if set, ok := iter.valueSet(); ok {
+		lo, hi := iter.rest()
+		return iter.data.countVals(set, lo, hi)
+	}
+	return walkCount(iter)
 }
 
 func (iter *ColumnIterator) Reversed() bool {
@@ -159,23 +245,39 @@ func (iter *ColumnIterator) JumpTo(id IDEntry) bool {
 }
 
 func (iter *ColumnIterator) HasNext() bool {
-	ipos, igrow, imin, imax, ifv, ifneq, iempty := iter.pos, iter.grow, iter.minpos, iter.maxpos, iter.filterVal, iter.filterNEQ, iter.col.empty
+	ipos, igrow, imin, imax, ifv, ifneq, iempty := iter.pos, iter.grow, iter.minpos, iter.maxpos, iter.filterVal, iter.filterNEQ, iter.data.empty
+	del := iter.data.del
 	ipos += igrow
 
 	if ipos >= imin && ipos <= imax {
 		if iter.useFilter {
-			if iter.use1b {
+			if iter.data.use8b && (ifv >= 0 || !iter.filterSet.isEmpty()) {
+				set, _ := iter.valueSet()
+				ipos = iter.data.scan8(ipos, igrow, imin, imax, set)
+			} else if !iter.filterSet.isEmpty() {
+				for {
+					v := iter.data.Get(IDEntry(ipos))
+					if iter.filterSet.has(v) {
+						break
+					}
+					ipos += igrow
+					if ipos < imin || ipos > imax {
+						break
+					}
+				}
+			} else if iter.data.use1b {
 			lp:
 				for {
 					pos, sub := ipos>>6, uint32(ipos)&0x3f
-					vv := iter.col.bmp[pos]
+					vv := iter.data.bmp.word(int32(pos))
 					mask := uint64(1) << sub
 					cmpv := uint64(ifv) << sub
 					if igrow > 0 {
 						cnt := 0x40 - sub
 						for cnt > 0 {
-							if (ifneq && cmpv != vv&mask) ||
-								(!ifneq && cmpv == vv&mask) {
+							if ((ifneq && cmpv != vv&mask) ||
+								(!ifneq && cmpv == vv&mask)) &&
+								!del.isSet(uint32(ipos)) {
 								break lp
 							}
 							mask = mask << 1
@@ -189,8 +291,9 @@ func (iter *ColumnIterator) HasNext() bool {
 					} else {
 						cnt := sub + 1
 						for cnt > 0 {
-							if (ifneq && cmpv != vv&mask) ||
-								(!ifneq && cmpv == vv&mask) {
+							if ((ifneq && cmpv != vv&mask) ||
+								(!ifneq && cmpv == vv&mask)) &&
+								!del.isSet(uint32(ipos)) {
 								break lp
 							}
 							mask = mask >> 1
@@ -203,18 +306,19 @@ func (iter *ColumnIterator) HasNext() bool {
 						}
 					}
 				}
-			} else if iter.use2b {
+			} else if iter.data.use2b {
 			lp2:
 				for {
 					pos, sub := ipos>>5, uint32(ipos)&0x1f
-					vv := iter.col.bmp[pos]
+					vv := iter.data.bmp.word(int32(pos))
 					mask := uint64(3) << (sub * 2)
 					cmpv := uint64(ifv) << (sub * 2)
 					if igrow > 0 {
 						cnt := 0x20 - sub
 						for cnt > 0 {
-							if (ifneq && cmpv != vv&mask) ||
-								(!ifneq && cmpv == vv&mask) {
+							if ((ifneq && cmpv != vv&mask) ||
+								(!ifneq && cmpv == vv&mask)) &&
+								!del.isSet(uint32(ipos)) {
 								break lp2
 							}
 							mask = mask << 2
@@ -228,8 +332,9 @@ func (iter *ColumnIterator) HasNext() bool {
 					} else {
 						cnt := sub + 1
 						for cnt > 0 {
-							if (ifneq && cmpv != vv&mask) ||
-								(!ifneq && cmpv == vv&mask) {
+							if ((ifneq && cmpv != vv&mask) ||
+								(!ifneq && cmpv == vv&mask)) &&
+								!del.isSet(uint32(ipos)) {
 								break lp2
 							}
 							mask = mask >> 2
@@ -244,7 +349,7 @@ func (iter *ColumnIterator) HasNext() bool {
 				}
 			} else {
 				for {
-					v := iter.col.Get(IDEntry(ipos))
+					v := iter.data.Get(IDEntry(ipos))
 					if ifneq && v != ifv && v != NullEntry && v != iempty {
 						break
 					}
@@ -258,7 +363,7 @@ func (iter *ColumnIterator) HasNext() bool {
 				}
 			}
 		} else {
-			for !iter.col.Contains(IDEntry(ipos)) {
+			for !iter.data.Contains(IDEntry(ipos)) {
 				ipos += igrow
 				if ipos < imin || ipos > imax {
 					break
@@ -274,6 +379,30 @@ func (iter *ColumnIterator) NextID() IDEntry {
 	return IDEntry(iter.pos)
 }
 
+// scan8 returns the first position from ipos in the direction igrow having a value from set, only for use8b.
+// It compares all 8 slots of the bitmap word at once.
+func (c *colData) scan8(ipos, igrow, imin, imax int32, set valMask) int32 {
+	_, ones := c.slots()
+	for ipos >= imin && ipos <= imax {
+		w := ipos >> 3
+		match := matchSlots(c.bmp.word(w), set, 8, ones)
+		match &^= spread8(c.del.word(w>>3) >> uint(w&0x07*8))
+		sub := uint(ipos & 0x07)
+		if igrow > 0 {
+			if match &= ^uint64(0) << (sub * 8); match != 0 {
+				return w<<3 + int32(bits.TrailingZeros64(match)>>3)
+			}
+			ipos = (w + 1) << 3
+		} else {
+			if match &= ^uint64(0) >> ((7 - sub) * 8); match != 0 {
+				return w<<3 + int32((63-bits.LeadingZeros64(match))>>3)
+			}
+			ipos = w<<3 - 1
+		}
+	}
+	return ipos
+}
+
 type RangeIterator struct {
 	pos        int32
 	grow       int32
@@ -295,6 +424,25 @@ func (iter *RangeIterator) Cardinality() int32 {
 	return iter.maxpos - iter.minpos + 1
 }
 
+func (iter *RangeIterator) EstimatedCardinality() int {
+	return int(iter.Cardinality())
+}
+
+func (iter *RangeIterator) ExactCount() int {
+	if iter.maxpos < 0 {
+		return 0
+	}
+	n := iter.pos - iter.minpos
+	if iter.grow > 0 {
+		n = iter.maxpos - iter.pos
+	}
+	if n < 0 {
+		// HasNext сдвигает pos и за границы
+		return 0
+	}
+	return int(n)
+}
+
 func (iter *RangeIterator) Reversed() bool {
 	return iter.grow < 0
 }
@@ -441,6 +589,13 @@ type IntersectIterator struct {
 	notIntersect bool
 }
 
+// checkIDOrder panics on iterators returning IDs not in order of IDs, they can't be intersected or merged
+func checkIDOrder(it IDIterator) {
+	if _, ok := it.(*OrderedIterator); ok {
+		panic("OrderedIterator can't be intersected or merged")
+	}
+}
+
 func NewIteratorIntersect(reversed bool) *IntersectIterator {
 	return &IntersectIterator{
 		iterators: make([]IDIterator, 0, 10),
@@ -452,6 +607,15 @@ func NewIteratorIntersect(reversed bool) *IntersectIterator {
 func (iter *IntersectIterator) Clone() IDIterator {
 	rv := &IntersectIterator{}
 	*rv = *iter
+	// клон не должен сдвигать итераторы оригинала
+	rv.iterators = make([]IDIterator, len(iter.iterators))
+	for i, it := range iter.iterators {
+		rv.iterators[i] = it.Clone()
+	}
+	rv.iterdiffs = make([]IDIterator, len(iter.iterdiffs))
+	for i, it := range iter.iterdiffs {
+		rv.iterdiffs[i] = it.Clone()
+	}
 	return rv
 }
 
@@ -459,6 +623,7 @@ func (iter *IntersectIterator) Append(iterator IDIterator) {
 	if iterator == nil {
 		return
 	}
+	checkIDOrder(iterator)
 	if iter.reversed != iter.Reversed() {
 		panic("iterators have different reverse order")
 	}
@@ -502,6 +667,7 @@ func (iter *IntersectIterator) AppendDiff(iterator IDIterator) {
 	if iterator == nil {
 		return
 	}
+	checkIDOrder(iterator)
 	if iter.reversed != iter.Reversed() {
 		panic("iterators have different reverse order")
 	}
@@ -580,10 +746,33 @@ func (iter *IntersectIterator) JumpTo(id IDEntry) bool {
 }
 
 func (iter *IntersectIterator) Cardinality() int32 {
-	// не может быть длинее самого короткого (индекс 0) из итераторов
+	// оценка самого короткого (индекс 0) из итераторов
 	return iter.iterators[0].Cardinality()
 }
 
+// EstimatedCardinality considers the iterators independent:
+// the shortest one is reduced by the density of others in their ranges
+func (iter *IntersectIterator) EstimatedCardinality() int {
+	if iter.notIntersect || len(iter.iterators) == 0 {
+		return 0
+	}
+	est := float64(iter.iterators[0].EstimatedCardinality())
+	for _, it := range iter.iterators[1:] {
+		est *= density(it)
+	}
+	for _, it := range iter.iterdiffs {
+		est *= 1 - density(it)
+	}
+	return int(est + 0.5)
+}
+
+func (iter *IntersectIterator) ExactCount() int {
+	if iter.notIntersect || len(iter.iterators) == 0 {
+		return 0
+	}
+	return walkCount(iter)
+}
+
 func (iter *IntersectIterator) Range() (IDEntry, IDEntry) {
 	return iter.iterators[0].Range()
 }
@@ -697,6 +886,7 @@ func NewIteratorMerge(iterators ...IDIterator) *MergeIterator {
 		if it == nil {
 			continue
 		}
+		checkIDOrder(it)
 		if reversed != it.Reversed() {
 			panic("iterators have different reverse order")
 		}
@@ -777,6 +967,28 @@ func (iter *MergeIterator) Cardinality() int32 {
 	return iter.cardinality
 }
 
+// EstimatedCardinality sums the iterators, but not more than the range of IDs
+func (iter *MergeIterator) EstimatedCardinality() int {
+	n := 0
+	for _, it := range iter.iterators {
+		if it != nil {
+			n += it.EstimatedCardinality()
+		}
+	}
+	if span := int(iter.max) - int(iter.min) + 1; n > span {
+		n = span
+	}
+	return n
+}
+
+// ExactCount sums lengths of disjoint posting lists of one column, otherwise walks the clone
+func (iter *MergeIterator) ExactCount() int {
+	if n, ok := iter.countDisjoint(); ok {
+		return n
+	}
+	return walkCount(iter)
+}
+
 func (iter *MergeIterator) Range() (l IDEntry, r IDEntry) {
 	return iter.min, iter.max
 }
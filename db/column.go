@@ -2,6 +2,7 @@ package db
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 type DataEntry int32
@@ -14,45 +15,89 @@ func valFunc(l, h, m uint32) uint32 { return h*m + l }
 
 type valEntry struct {
 	rem uint32
-	ids []IDEntry
+	ids []IDEntry // список ID, если bm == nil
+	bm  *roaring  // сжатый список ID для длинных списков
 }
 
-type kvSet struct {
-	id  IDEntry
-	val DataEntry
+func (ve *valEntry) length() int {
+	if ve.bm != nil {
+		return ve.bm.n
+	}
+	return len(ve.ids)
 }
 
-type Column struct {
-	sync.RWMutex
+func (ve *valEntry) appendIDs(dst []IDEntry) []IDEntry {
+	if ve.bm != nil {
+		return ve.bm.appendIDs(dst)
+	}
+	return append(dst, ve.ids...)
+}
 
+// list returns IDs of the list, the slice of IDs is returned without copying
+func (ve *valEntry) list() []IDEntry {
+	if ve.bm != nil {
+		return ve.bm.appendIDs(make([]IDEntry, 0, ve.bm.n))
+	}
+	return ve.ids
+}
+
+type kvSet struct {
+	id   IDEntry
+	val  DataEntry
+	upd  bool
+	done chan struct{} // барьер Sync, если не nil
+}
+
+// colData - данные колонки, которые читают итераторы.
+// Итератор получает копию colData, после этого слайсы не меняются на месте,
+// а копируются перед записью (copy-on-write), пока итераторы не будут собраны GC.
+// Биткарты копируются по кускам, которые меняются.
+type colData struct {
 	// кластерный индекс, сортирован в порядке возрастания ключа (ID)
 	// индекс коллекции - это ID
 	// могут быть пропуски ID, в них DataEntry==empty
 	cluster []DataEntry
 
+	bmp chunks // биткарта, растет кусками
+	del chunks // биткарта удаленных ID для use1b, use2b, use4b, use8b, создается при первом удалении
+
+	useval bool
+	use1b  bool // биткарта, 1 бит на значение
+	use2b  bool // биткарта, 2 бит на значение
+	use4b  bool // биткарта, 4 бит на значение
+	use8b  bool // биткарта, 8 бит на значение
+
+	empty DataEntry // для use1b Contains работает просто как проверка границ, для остальных - проверяет на это пустое значение
+}
+
+type Column struct {
+	epoch uint64 // увеличивается атомарно под блокировкой на чтение при выдаче сжатого списка итератору и в own для кусков биткарт, первым полем для выравнивания на 32-битных платформах
+
+	sync.RWMutex
+
+	colData
+	shared int32 // colData выдана итераторам, меняется атомарно под блокировкой на чтение
+
 	// индекс, по значению (DataEntry), отсортирован только в рамках одного bucket
 	// все одинаковые значения находятся в одном bucket
 	// позволяет быстро найти по значению все ID, отсортированные по возрастанию
 	// индекс коллекции - значение DataEntry
+	// слайсы ids не меняются на месте, кроме добавления в конец,
+	// сжатые списки bm меняются на месте только в эпохе, в которой они созданы или скопированы
 	bucketsCount uint32
 	values       [][]valEntry
 
-	bmp   []uint64 // биткарта
-	count []int32  // количества по idx=val
+	count []int32 // количества по idx=val
 
 	dict *Dictonary
 
-	useval bool
-	use1b  bool // биткарта, 1 бит на значение
-	use2b  bool // биткарта, 2 бит на значение
-	use4b  bool // биткарта, 4 бит на значение
-
 	minId IDEntry
 	maxId IDEntry
 
-	empty DataEntry // для use1b Contains работает просто как проверка границ, для остальных - проверяет на это пустое значение
-
-	chset chan kvSet
+	chset      chan kvSet
+	chmu       sync.RWMutex // отправка в chset блокирует его для чтения, закрытие - для записи
+	workerDone chan struct{}
+	closed     bool // под chmu
 }
 
 func NewColumnZeroVal(lines, vals int, zeroval ColumnValue) *Column {
@@ -62,51 +107,158 @@ func NewColumnZeroVal(lines, vals int, zeroval ColumnValue) *Column {
 
 func NewColumnZeroDataEntry(lines, vals int, dct *Dictonary, zeroval DataEntry) *Column {
 	ret := &Column{
+		colData: colData{
+			empty: zeroval,
+		},
 		minId: 0xffffffff,
 		dict:  dct,
-		empty: zeroval,
-		chset: make(chan kvSet, 1000),
 	}
+	ret.encode(lines, vals)
+	ret.startWorker()
+	return ret
+}
+
+// encode allocates the empty storage of the encoding for lines IDs and vals unique values
+func (c *Column) encode(lines, vals int) {
 	if vals <= 2 {
-		ret.use1b = true
-		ret.bmp = make([]uint64, 1+(lines>>6))
-		ret.count = make([]int32, 2)
+		c.use1b = true
+		c.bmp = newChunks(1+(lines>>6), atomic.LoadUint64(&c.epoch))
+		c.count = make([]int32, 2)
 	} else if vals <= 4 {
-		ret.use2b = true
-		ret.bmp = make([]uint64, 1+(lines>>5))
-		ret.count = make([]int32, 4)
+		c.use2b = true
+		c.bmp = newChunks(1+(lines>>5), atomic.LoadUint64(&c.epoch))
+		c.count = make([]int32, 4)
 	} else if vals <= 16 {
-		ret.use4b = true
-		ret.bmp = make([]uint64, 1+(lines>>4))
-		ret.count = make([]int32, 16)
+		c.use4b = true
+		c.bmp = newChunks(1+(lines>>4), atomic.LoadUint64(&c.epoch))
+		c.count = make([]int32, 16)
+	} else if vals <= 256 {
+		c.use8b = true
+		c.bmp = newChunks(1+(lines>>3), atomic.LoadUint64(&c.epoch))
+		c.count = make([]int32, 256)
 	} else {
 		d := lines / vals // lines per one value
 		switch {
 		case d > 10000000:
-			ret.bucketsCount = 1 << 20
+			c.bucketsCount = 1 << 20
 		case d > 1000000:
-			ret.bucketsCount = 1 << 16
+			c.bucketsCount = 1 << 16
 		case d > 100000:
-			ret.bucketsCount = 1 << 13
+			c.bucketsCount = 1 << 13
 		case d > 10000:
-			ret.bucketsCount = 1 << 10
+			c.bucketsCount = 1 << 10
 		default:
-			ret.bucketsCount = 1 << 8
+			c.bucketsCount = 1 << 8
 		}
-		ret.cluster = make([]DataEntry, 0, lines)
-		ret.values = make([][]valEntry, ret.bucketsCount)
-		ret.useval = true
+		c.cluster = make([]DataEntry, 0, lines)
+		c.values = make([][]valEntry, c.bucketsCount)
+		c.useval = true
 	}
-	go ret.workerSet()
-	return ret
+}
+
+// reencode moves values of the bitmap column to the encoding having room for the value v,
+// when the dictonary has outgrown UniqueValues of the column. It must be called under the column lock,
+// iterators keep reading the previous data.
+func (c *Column) reencode(v DataEntry) {
+	vals := c.dict.Length()
+	if vals <= int(v) {
+		vals = int(v) + 1
+	}
+	old := c.colData
+	per, _ := old.slots()
+	count := c.count
+
+	c.colData = colData{empty: old.empty}
+	c.count = nil
+	c.encode(int(old.bmp.len()*per), vals)
+	if c.minId > c.maxId {
+		return
+	}
+	if c.useval {
+		// ID без значений отмечены удаленными и читаются как NullEntry, см. set
+		for id := c.minId; ; id++ {
+			if v := old.Get(id); v != NullEntry {
+				c.set(id, v)
+			}
+			if id == c.maxId {
+				break
+			}
+		}
+		return
+	}
+	for id := c.minId; ; id++ {
+		if v := old.Get(id); v > 0 {
+			c.setBits(id, v)
+		}
+		if id == c.maxId {
+			break
+		}
+	}
+	copy(c.count, count)
+	// копируется при изменении, если выдана итераторам
+	c.del = old.del
+}
+
+// remap returns the column rebuilt with dct, idx maps values of the column to indexes of dct.
+// The column is closed.
+func (c *Column) remap(dct *Dictonary, idx []DictIndex, lines, vals int) (*Column, error) {
+	defer c.Close()
+	if int(c.empty) >= len(idx) {
+		return nil, ErrSnapshotFormat
+	}
+	ret := NewColumnZeroDataEntry(lines, vals, dct, DataEntry(idx[c.empty]))
+	if c.minId > c.maxId {
+		return ret, nil
+	}
+	for id := c.minId; ; id++ {
+		if v := c.Get(id); v != NullEntry {
+			if int(v) >= len(idx) {
+				ret.Close()
+				return nil, ErrSnapshotFormat
+			}
+			ret.Set(id, DataEntry(idx[v]), false, false)
+		}
+		if id == c.maxId {
+			break
+		}
+	}
+	return ret, nil
+}
+
+func (c *Column) startWorker() {
+	c.chset = make(chan kvSet, 1000)
+	c.workerDone = make(chan struct{})
+	go c.workerSet()
 }
 
 func (c *Column) workerSet() {
+	defer close(c.workerDone)
 	for kv := range c.chset {
-		c.set(kv.id, kv.val)
+		if kv.done != nil {
+			close(kv.done)
+			continue
+		}
+		c.Lock()
+		c.Set(kv.id, kv.val, kv.upd, false)
+		c.Unlock()
 	}
 }
 
+// Sync waits until all async writes queued before the call are applied.
+// Must be called without the column lock.
+func (c *Column) Sync() {
+	done := make(chan struct{})
+	c.chmu.RLock()
+	if c.closed {
+		// очередь применена в Close
+		c.chmu.RUnlock()
+		return
+	}
+	c.chset <- kvSet{done: done}
+	c.chmu.RUnlock()
+	<-done
+}
+
 func (c *Column) SetVal(id IDEntry, v ColumnValue, upd, async bool) {
 	if v == nil {
 		c.Set(id, c.empty, upd, async)
@@ -184,27 +336,118 @@ func binApproxSearchIDEntry(a []IDEntry, x IDEntry) uint32 {
 	return i
 }
 
+// view returns the column data for an iterator, must be called under the column read lock
+func (c *Column) view() colData {
+	atomic.StoreInt32(&c.shared, 1)
+	return c.colData
+}
+
+// own copies the data given to iterators before changing it in place, must be called under the column lock.
+// Chunks of bitmaps are copied later by one, when they are changed.
+func (c *Column) own() {
+	if atomic.LoadInt32(&c.shared) == 0 {
+		return
+	}
+	// куски биткарт копируются при первом изменении в новой эпохе
+	atomic.AddUint64(&c.epoch, 1)
+	if c.bmp != nil {
+		c.bmp = append(chunks(nil), c.bmp...)
+	}
+	if c.del != nil {
+		c.del = append(chunks(nil), c.del...)
+	}
+	if c.cluster != nil {
+		c.cluster = append(make([]DataEntry, 0, cap(c.cluster)), c.cluster...)
+	}
+	atomic.StoreInt32(&c.shared, 0)
+}
+
 func (c *Column) setCluster(id IDEntry, v DataEntry, clearset bool) {
+	if uint32(id) < uint32(len(c.cluster)) {
+		c.own()
+	}
 	for uint32(len(c.cluster)) <= uint32(id) {
 		c.cluster = append(c.cluster, NullEntry)
 	}
 	c.cluster[uint32(id)] = v
 }
 
-// нельзя вызывать для бинарных!
+func (c *colData) isDeleted(id IDEntry) bool {
+	return c.del.isSet(uint32(id))
+}
+
+// exists reports whether id has a value, zero values are counted too.
+// IDs of bitmap columns between minId and maxId without values are marked as deleted, see set.
+func (c *Column) exists(id IDEntry) bool {
+	if id < c.minId || id > c.maxId {
+		return false
+	}
+	if c.useval {
+		return c.Get(id) != NullEntry
+	}
+	return !c.isDeleted(id)
+}
+
+// Remove deletes the value of id for any column encoding
+func (c *Column) Remove(id IDEntry) {
+	if !c.exists(id) {
+		return
+	}
+	if c.useval {
+		c.Delete(id, c.Get(id))
+	} else {
+		c.own()
+		v := c.Get(id)
+		if c.count[v] > 0 {
+			c.count[v]--
+		}
+		c.setBits(id, 0)
+		n := uint32(id)
+		*c.del.at(int32(n>>6), atomic.LoadUint64(&c.epoch)) |= uint64(1) << (n & 0x3f)
+	}
+
+	// сдвигаем границы
+	if id == c.minId {
+		for c.minId < c.maxId && !c.exists(c.minId+1) {
+			c.minId++
+		}
+		c.minId++
+	}
+	if id == c.maxId {
+		for c.maxId > c.minId && !c.exists(c.maxId-1) {
+			c.maxId--
+		}
+		c.maxId--
+	}
+	if c.minId > c.maxId {
+		c.minId = 0xffffffff
+		c.maxId = 0
+	}
+}
+
+// Delete removes id from the value oldv, only for bucketed columns, see Remove
 func (c *Column) Delete(id IDEntry, oldv DataEntry) {
 	bck, rem := remFunc(uint32(oldv), c.bucketsCount)
 	cv := c.values[bck]
 	ln := len(cv)
 	ii := int(binSearchValEntryFirst(cv, rem))
 	if ii < ln && cv[ii].rem == rem {
-		lnids := len(cv[ii].ids)
-		iids := int(binApproxSearchIDEntry(cv[ii].ids, id))
-		if iids < lnids && cv[ii].ids[iids] == id {
-			if iids < lnids-1 {
-				copy(cv[ii].ids[iids:], cv[ii].ids[iids+1:])
+		if bm := cv[ii].bm; bm != nil {
+			epoch := atomic.LoadUint64(&c.epoch)
+			bm = bm.own(epoch)
+			bm.remove(id, epoch)
+			if bm.n < roaringMinIDs/2 {
+				// короткий список снова хранится слайсом
+				cv[ii].ids = bm.appendIDs(make([]IDEntry, 0, bm.n))
+				bm = nil
 			}
-			cv[ii].ids = cv[ii].ids[:lnids-1]
+			cv[ii].bm = bm
+		} else if lnids, iids := len(cv[ii].ids), int(binApproxSearchIDEntry(cv[ii].ids, id)); iids < lnids && cv[ii].ids[iids] == id {
+			// новый слайс, старый мог быть выдан итераторам
+			ids := make([]IDEntry, lnids-1, cap(cv[ii].ids))
+			copy(ids, cv[ii].ids[:iids])
+			copy(ids[iids:], cv[ii].ids[iids+1:])
+			cv[ii].ids = ids
 		}
 		c.values[bck] = cv
 		c.setCluster(id, NullEntry, false)
@@ -212,6 +455,20 @@ func (c *Column) Delete(id IDEntry, oldv DataEntry) {
 }
 
 func (c *Column) set(id IDEntry, v DataEntry) {
+	bitmap := c.use1b || c.use2b || c.use4b || c.use8b
+	if bitmap {
+		c.own()
+		// ID между прежними границами и id не имеют значений, отмечаем их удаленными
+		epoch := atomic.LoadUint64(&c.epoch)
+		switch {
+		case c.minId > c.maxId:
+		case id > c.maxId && id-c.maxId > 1:
+			c.del.setRange(uint32(c.maxId)+1, uint32(id)-1, epoch)
+		case id < c.minId && c.minId-id > 1:
+			c.del.setRange(uint32(id)+1, uint32(c.minId)-1, epoch)
+		}
+	}
+
 	if c.maxId < id {
 		c.maxId = id
 	}
@@ -220,46 +477,42 @@ func (c *Column) set(id IDEntry, v DataEntry) {
 		c.minId = id
 	}
 
-	if c.use1b {
-		pos, sub := id>>6, id&0x3f
-		mask := uint64(1) << sub
-		if v == 1 {
-			c.bmp[pos] |= mask
-		} else {
-			c.bmp[pos] &^= mask
+	if bitmap {
+		c.setBits(id, v)
+		if c.del.isSet(uint32(id)) {
+			*c.del.at(int32(id>>6), atomic.LoadUint64(&c.epoch)) &^= uint64(1) << (uint32(id) & 0x3f)
 		}
 		c.count[v]++
 		return
-	} else if c.use2b {
-		pos, sub := id>>5, id&0x1f
-		mask := uint64(3) << (sub * 2)
-		c.bmp[pos] &^= mask
-		c.bmp[pos] |= (uint64(v) & 0x3) << (sub * 2)
-		c.count[v]++
-		return
-	} else if c.use4b {
-		pos, sub := id>>4, id&0x0f
-		mask := uint64(0x0f) << (sub * 4)
-		c.bmp[pos] &^= mask
-		c.bmp[pos] |= (uint64(v) & 0x0f) << (sub * 4)
-		c.count[v]++
-		return
 	}
 
 	bck, rem := remFunc(uint32(v), c.bucketsCount)
 	cv := c.values[bck]
 	ln := len(cv)
 	ii := int(binSearchValEntryFirst(cv, rem))
-	if ii < ln && cv[ii].rem == rem {
+	if ii < ln && cv[ii].bm != nil && cv[ii].rem == rem {
+		epoch := atomic.LoadUint64(&c.epoch)
+		cv[ii].bm = cv[ii].bm.own(epoch)
+		cv[ii].bm.add(id, epoch)
+	} else if ii < ln && cv[ii].rem == rem {
 		// уже есть значение - пробуем добавить ID
 		lnids := len(cv[ii].ids)
 		iids := int(binApproxSearchIDEntry(cv[ii].ids, id))
 		// если уже есть - не добавляем
 		if !(iids < lnids && cv[ii].ids[iids] == id) {
-			cv[ii].ids = append(cv[ii].ids, id)
 			if iids < lnids {
-				copy(cv[ii].ids[iids+1:], cv[ii].ids[iids:])
-				cv[ii].ids[iids] = id
+				// вставка в середину - в новый слайс, старый мог быть выдан итераторам
+				ids := make([]IDEntry, lnids+1, lnids+1+lnids>>2)
+				copy(ids, cv[ii].ids[:iids])
+				ids[iids] = id
+				copy(ids[iids+1:], cv[ii].ids[iids:])
+				cv[ii].ids = ids
+			} else {
+				cv[ii].ids = append(cv[ii].ids, id)
+			}
+			if n := len(cv[ii].ids); n&(n-1) == 0 {
+				// проверяем, когда длина списка становится степенью двойки
+				c.compress(&cv[ii])
 			}
 		}
 	} else {
@@ -280,11 +533,78 @@ func (c *Column) set(id IDEntry, v DataEntry) {
 	c.setCluster(id, v, false)
 }
 
+func (c *Column) setBits(id IDEntry, v DataEntry) {
+	epoch := atomic.LoadUint64(&c.epoch)
+	if c.use1b {
+		w, sub := c.bmp.at(int32(id>>6), epoch), id&0x3f
+		mask := uint64(1) << sub
+		if v == 1 {
+			*w |= mask
+		} else {
+			*w &^= mask
+		}
+	} else if c.use2b {
+		w, sub := c.bmp.at(int32(id>>5), epoch), id&0x1f
+		mask := uint64(3) << (sub * 2)
+		*w &^= mask
+		*w |= (uint64(v) & 0x3) << (sub * 2)
+	} else if c.use4b {
+		w, sub := c.bmp.at(int32(id>>4), epoch), id&0x0f
+		mask := uint64(0x0f) << (sub * 4)
+		*w &^= mask
+		*w |= (uint64(v) & 0x0f) << (sub * 4)
+	} else if c.use8b {
+		w, sub := c.bmp.at(int32(id>>3), epoch), id&0x07
+		mask := uint64(0xff) << (sub * 8)
+		*w &^= mask
+		*w |= (uint64(v) & 0xff) << (sub * 8)
+	}
+}
+
+// Close applies queued async writes, stops the column worker and releases memory.
+// The column must not be used after Close, only Sync and async writes are ignored.
+func (c *Column) Close() {
+	c.chmu.Lock()
+	if c.closed {
+		c.chmu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.chset)
+	c.chmu.Unlock()
+	<-c.workerDone
+
+	c.Lock()
+	c.cluster = nil
+	c.values = nil
+	c.bmp = nil
+	c.count = nil
+	c.del = nil
+	c.Unlock()
+}
+
+// Set must be called under the column lock, but async writes must be queued without it,
+// they are applied by the column worker under the lock.
 func (c *Column) Set(id IDEntry, v DataEntry, upd, async bool) {
+	if async {
+		c.chmu.RLock()
+		if !c.closed {
+			c.chset <- kvSet{id: id, val: v, upd: upd}
+		}
+		c.chmu.RUnlock()
+		return
+	}
+
+	if !c.useval && int(v) >= len(c.count) {
+		c.reencode(v)
+	}
+
 	if upd {
-		if c.use1b || c.use2b || c.use4b {
-			oldv := c.Get(id)
-			c.count[oldv]--
+		if c.use1b || c.use2b || c.use4b || c.use8b {
+			// ID без значения читается из биткарты как 0
+			if oldv := c.Get(id); c.exists(id) && c.count[oldv] > 0 {
+				c.count[oldv]--
+			}
 		} else {
 			oldv := c.Get(id)
 			if oldv != NullEntry {
@@ -297,29 +617,34 @@ func (c *Column) Set(id IDEntry, v DataEntry, upd, async bool) {
 		}
 	}
 
-	if async {
-		c.chset <- kvSet{id, v}
-	} else {
-		c.set(id, v)
-	}
+	c.set(id, v)
 }
 
-func (c *Column) Get(id IDEntry) DataEntry {
+func (c *colData) Get(id IDEntry) DataEntry {
 	switch {
 	case c.useval:
+		if uint32(id) >= uint32(len(c.cluster)) {
+			return NullEntry
+		}
 		return c.cluster[uint32(id)]
+	case c.isDeleted(id):
+		return NullEntry
 	case c.use1b:
-		pos, sub := id>>6, id&0x3f
+		pos, sub := int32(id>>6), id&0x3f
 		mask := uint64(1) << sub
-		return DataEntry((c.bmp[pos] & mask) >> sub)
+		return DataEntry((c.bmp.word(pos) & mask) >> sub)
 	case c.use2b:
-		pos, sub := id>>5, id&0x1f
+		pos, sub := int32(id>>5), id&0x1f
 		mask := uint64(3) << (sub * 2)
-		return DataEntry((c.bmp[pos] & mask) >> (sub * 2))
+		return DataEntry((c.bmp.word(pos) & mask) >> (sub * 2))
 	case c.use4b:
-		pos, sub := id>>4, id&0x0f
+		pos, sub := int32(id>>4), id&0x0f
 		mask := uint64(0x0f) << (sub * 4)
-		return DataEntry((c.bmp[pos] & mask) >> (sub * 4))
+		return DataEntry((c.bmp.word(pos) & mask) >> (sub * 4))
+	case c.use8b:
+		pos, sub := int32(id>>3), id&0x07
+		mask := uint64(0xff) << (sub * 8)
+		return DataEntry((c.bmp.word(pos) & mask) >> (sub * 8))
 	default:
 		panic("unknown column for Get")
 	}
@@ -362,108 +687,221 @@ func (c *Column) DictCardinality() int {
 	return c.dict.Length()
 }
 
-func (c *Column) Contains(id IDEntry) bool {
+func (c *colData) Contains(id IDEntry) bool {
 	switch {
+	case c.isDeleted(id):
+		return false
 	case c.use1b:
-		return int(id>>6) < len(c.bmp)
+		return int32(id>>6) < c.bmp.len()
 	case c.use2b:
-		pos, sub := id>>5, id&0x1f
+		pos, sub := int32(id>>5), id&0x1f
 		mask := uint64(3) << (sub * 2)
-		return DataEntry((c.bmp[pos]&mask)>>(sub*2)) != 0
+		return DataEntry((c.bmp.word(pos)&mask)>>(sub*2)) != 0
 	case c.use4b:
-		pos, sub := id>>4, id&0x0f
+		pos, sub := int32(id>>4), id&0x0f
 		mask := uint64(0x0f) << (sub * 4)
-		return DataEntry((c.bmp[pos]&mask)>>(sub*4)) != 0
+		return DataEntry((c.bmp.word(pos)&mask)>>(sub*4)) != 0
+	case c.use8b:
+		pos, sub := int32(id>>3), id&0x07
+		mask := uint64(0xff) << (sub * 8)
+		return DataEntry((c.bmp.word(pos)&mask)>>(sub*8)) != 0
 	default:
 		v := c.cluster[uint32(id)]
 		return !(v == NullEntry || v == c.empty)
 	}
 }
 
+// GetV returns ascending IDs having the value v, compressed lists are unpacked to a new slice
 func (c *Column) GetV(v DataEntry) []IDEntry {
-	if c.use1b || c.use2b || c.use4b {
+	if c.use1b || c.use2b || c.use4b || c.use8b {
 		panic("GetV is not defined for bitmap columns")
 	}
+	ve := c.posting(v)
+	switch {
+	case ve == nil:
+		return nil
+	case ve.bm != nil:
+		return ve.bm.appendIDs(make([]IDEntry, 0, ve.bm.n))
+	}
+	return ve.ids
+}
+
+// posting returns the list of IDs of the value of the bucketed column, nil if there are no IDs
+func (c *Column) posting(v DataEntry) *valEntry {
 	bck, rem := remFunc(uint32(v), c.bucketsCount)
 	cv := c.values[bck]
-	ln := len(cv)
 	ii := int(binSearchValEntryFirst(cv, rem))
-	if ii < ln && cv[ii].rem == rem {
-		return cv[ii].ids
+	if ii < len(cv) && cv[ii].rem == rem && cv[ii].length() > 0 {
+		return &cv[ii]
 	}
 	return nil
 }
 
-// FIXME: compare ColumnValues instead of DataEntry
+// compress stores the list of IDs in containers, if it takes less memory
+func (c *Column) compress(ve *valEntry) {
+	n := len(ve.ids)
+	if n < roaringMinIDs {
+		return
+	}
+	if bm := newRoaring(ve.ids, atomic.LoadUint64(&c.epoch)); bm.size() < 4*n {
+		ve.ids, ve.bm = nil, bm
+	}
+}
+
 // FIXME: monotonic fast values buckets by range of values
 // TODO: buckets or t-tree?
 
+// IterateVUp calls f for v and greater values in ColumnValue.Compare order, skipping values without IDs,
+// until f returns false
 func (c *Column) IterateVUp(v DataEntry, f func(v DataEntry, ids []IDEntry) bool) {
-	if c.use1b || c.use2b || c.use4b {
+	if c.use1b || c.use2b || c.use4b || c.use8b {
 		panic("IterateUp is not defined for bitmap columns")
 	}
-	bcnt := c.bucketsCount
-	bck, rem := remFunc(uint32(v), c.bucketsCount)
-	cv := c.values[bck]
-	ln := uint32(len(cv))
-	ii := binSearchValEntryFirst(cv, rem)
-	for {
-		for ii >= ln {
-			bck++
-			if bck >= uint32(len(c.values)) {
-				break
-			}
-			cv = c.values[bck]
-			ln = uint32(len(cv))
-			ii = binSearchValEntryFirst(cv, rem)
+	ord, r := c.dict.position(DictIndex(v))
+	if r < 0 {
+		return
+	}
+	for _, n := range ord[r:] {
+		ids := c.GetV(DataEntry(n))
+		if len(ids) == 0 {
+			continue
 		}
-		if !f(DataEntry(valFunc(ii, cv[ii].rem, bcnt)), cv[ii].ids) {
+		if !f(DataEntry(n), ids) {
 			break
 		}
-		ii++
 	}
 }
 
+// IterateVDown calls f for v and lesser values in reverse ColumnValue.Compare order, skipping values without IDs,
+// until f returns false
 func (c *Column) IterateVDown(v DataEntry, f func(v DataEntry, ids []IDEntry) bool) {
-	if c.use1b || c.use2b || c.use4b {
-		panic("IterateUp is not defined for bitmap columns")
+	if c.use1b || c.use2b || c.use4b || c.use8b {
+		panic("IterateDown is not defined for bitmap columns")
 	}
-	bcnt := c.bucketsCount
-	bck, rem := remFunc(uint32(v), c.bucketsCount)
-	bcki := int32(bck)
-	cv := c.values[bcki]
-	ii := int32(binSearchValEntryLast(cv, rem))
-	for {
-		ii--
-		for ii < 0 {
-			bcki--
-			if bcki < 0 {
-				break
-			}
-			cv = c.values[bcki]
-			ii = int32(binSearchValEntryLast(cv, rem)) - 1
+	ord, r := c.dict.position(DictIndex(v))
+	for ; r >= 0; r-- {
+		n := ord[r]
+		ids := c.GetV(DataEntry(n))
+		if len(ids) == 0 {
+			continue
 		}
-		if !f(DataEntry(valFunc(uint32(ii), cv[ii].rem, bcnt)), cv[ii].ids) {
+		if !f(DataEntry(n), ids) {
 			break
 		}
 	}
 }
 
+func (c *Column) hasVal(v DataEntry) bool {
+	if c.use1b || c.use2b || c.use4b || c.use8b {
+		return int(v) < len(c.count) && c.count[v] > 0
+	}
+	return c.posting(v) != nil
+}
+
+// MinVal returns the least nonzero value stored in the column, false if there are no values
+func (c *Column) MinVal() (DataEntry, bool) {
+	for _, n := range c.dict.Ordered() {
+		if v := DataEntry(n); v != c.empty && c.hasVal(v) {
+			return v, true
+		}
+	}
+	return NullEntry, false
+}
+
+// MaxVal returns the greatest nonzero value stored in the column, false if there are no values
+func (c *Column) MaxVal() (DataEntry, bool) {
+	ord := c.dict.Ordered()
+	for i := len(ord) - 1; i >= 0; i-- {
+		if v := DataEntry(ord[i]); v != c.empty && c.hasVal(v) {
+			return v, true
+		}
+	}
+	return NullEntry, false
+}
+
+// idsOf returns ascending IDs having the value v
+func (c *Column) idsOf(v DataEntry) []IDEntry {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.hasVal(v) {
+		return nil
+	}
+	if c.useval {
+		ve := c.posting(v)
+		return ve.appendIDs(make([]IDEntry, 0, ve.length()))
+	}
+	var ret []IDEntry
+	iter := c.IteratorWithFilterVal(v, false, false)
+	for iter.HasNext() {
+		ret = append(ret, iter.NextID())
+	}
+	return ret
+}
+
+// valuesView returns value buckets of bucketed column to read without the lock.
+// Only entries of posting lists are copied: slices of IDs are not changed in place,
+// compressed lists are not changed in place after the epoch change.
+func (c *Column) valuesView() [][]valEntry {
+	c.RLock()
+	defer c.RUnlock()
+	atomic.AddUint64(&c.epoch, 1)
+	ret := make([][]valEntry, len(c.values))
+	for i, bucket := range c.values {
+		ret[i] = append([]valEntry(nil), bucket...)
+	}
+	return ret
+}
+
+// countOf returns the number of IDs with the value v, must be called under the column read lock
+func (c *Column) countOf(v DataEntry) int {
+	if c.useval {
+		if ve := c.posting(v); ve != nil {
+			return ve.length()
+		}
+		return 0
+	}
+	if v >= 0 && int(v) < len(c.count) {
+		return int(c.count[v])
+	}
+	return 0
+}
+
+// rows returns the number of IDs with values including empty ones, must be called under the column read lock
+func (c *Column) rows() int {
+	n := 0
+	if c.useval {
+		for _, bucket := range c.values {
+			for _, ve := range bucket {
+				n += ve.length()
+			}
+		}
+		return n
+	}
+	for _, cnt := range c.count {
+		n += int(cnt)
+	}
+	return n
+}
+
 func (c *Column) GetCountV(v DataEntry) int32 {
-	if c.use1b || c.use2b || c.use4b {
+	if c.use1b || c.use2b || c.use4b || c.use8b {
 		return c.count[v]
 	}
-	return int32(len(c.GetV(v)))
+	return int32(c.countOf(v))
 }
 
 func (c *Column) RangeVals(f func(v DataEntry, ids []IDEntry)) {
-	if c.use1b || c.use2b || c.use4b {
+	if c.use1b || c.use2b || c.use4b || c.use8b {
 		panic("RangeVals is not defined for bitmap columns")
 	} else {
 		bck := c.bucketsCount
 		for i, bucket := range c.values {
 			for _, val := range bucket {
-				f(DataEntry(valFunc(uint32(i), val.rem, bck)), val.ids)
+				if val.bm != nil {
+					f(DataEntry(valFunc(uint32(i), val.rem, bck)), val.appendIDs(nil))
+				} else {
+					f(DataEntry(valFunc(uint32(i), val.rem, bck)), val.ids)
+				}
 			}
 		}
 	}
@@ -1,5 +1,11 @@
 package db
 
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
 // ColumnValue - interface for values in columns
 // Make sure you use the value in this interface instead of the pointer.
 type ColumnValue interface {
@@ -12,12 +18,26 @@ type ColumnType struct {
 	ZeroValue    ColumnValue
 	Lines        int
 	UniqueValues int
+	Dictonary    *Dictonary // shared dictonary, e.g. for merge joins, nil for own dictonary of the column
 }
 
+var (
+	ErrColumnNotFound = errors.New("column not found")
+	ErrTableClosed    = errors.New("table is closed")
+)
+
 type DataTable struct {
 	metadata []*ColumnType
 	columns  []*Column
 	names    map[string]int
+
+	idmu  sync.Mutex
+	maxId IDEntry // максимальный ID по всем колонкам
+
+	wal    *WAL
+	walSeq uint64       // последняя запись WAL, примененная к таблице
+	walmu  sync.RWMutex // изменения блокируют его для чтения, контрольная точка и Close - для записи
+	closed bool         // под walmu
 }
 
 func (dt *DataTable) AddColumn(ct *ColumnType) int {
@@ -27,41 +47,276 @@ func (dt *DataTable) AddColumn(ct *ColumnType) int {
 	}
 	dt.names[ct.Name] = idx
 	dt.metadata = append(dt.metadata, ct)
-	dt.columns = append(dt.columns, NewColumnZeroVal(ct.Lines, ct.UniqueValues, ct.ZeroValue))
+	if ct.Dictonary != nil {
+		zv := DataEntry(ct.Dictonary.Put(ct.ZeroValue))
+		dt.columns = append(dt.columns, NewColumnZeroDataEntry(ct.Lines, ct.UniqueValues, ct.Dictonary, zv))
+	} else {
+		dt.columns = append(dt.columns, NewColumnZeroVal(ct.Lines, ct.UniqueValues, ct.ZeroValue))
+	}
 	ct.Index = idx
+	if dt.wal != nil {
+		// ошибку записи в WAL можно получить через WAL.Err
+		dt.wal.logAddColumn(dt, idx)
+	}
 	return idx
 }
 
+// DropColumn closes and removes the column, indexes of the next columns are shifted.
+// Like AddColumn, it must not be called concurrently with other operations on the table.
+func (dt *DataTable) DropColumn(colname string) error {
+	if dt.closed {
+		return ErrTableClosed
+	}
+	colidx, ok := dt.names[colname]
+	if !ok {
+		return ErrColumnNotFound
+	}
+	if dt.wal != nil {
+		if err := dt.wal.logDropColumn(colidx); err != nil {
+			return err
+		}
+	}
+	col := dt.columns[colidx]
+
+	dt.metadata = append(dt.metadata[:colidx], dt.metadata[colidx+1:]...)
+	dt.columns = append(dt.columns[:colidx], dt.columns[colidx+1:]...)
+	delete(dt.names, colname)
+	for i := colidx; i < len(dt.metadata); i++ {
+		dt.metadata[i].Index = i
+		dt.names[dt.metadata[i].Name] = i
+	}
+
+	col.Close()
+	return nil
+}
+
+// Close applies queued async writes, stops workers of all columns and closes the attached WAL.
+// Later changes of the table return ErrTableClosed.
+func (dt *DataTable) Close() error {
+	dt.walmu.Lock()
+	defer dt.walmu.Unlock()
+	if dt.closed {
+		return ErrTableClosed
+	}
+	dt.closed = true
+	for _, col := range dt.columns {
+		col.Close()
+	}
+	if dt.wal != nil {
+		err := dt.wal.Close()
+		dt.wal = nil
+		return err
+	}
+	return nil
+}
+
+func (dt *DataTable) newID() IDEntry {
+	dt.idmu.Lock()
+	dt.maxId++
+	id := dt.maxId
+	dt.idmu.Unlock()
+	return id
+}
+
+func (dt *DataTable) useID(id IDEntry) {
+	dt.idmu.Lock()
+	if dt.maxId < id {
+		dt.maxId = id
+	}
+	dt.idmu.Unlock()
+}
+
+// Insert sets value of one column, NewIDEntry allocates the next table-wide ID
 func (dt *DataTable) Insert(colindex int, id IDEntry, val ColumnValue, opts QueryOptions) IDEntry {
-	col := dt.columns[colindex]
-	col.Lock()
+	// ошибку записи в WAL можно получить через WAL.Err
+	id, _ = dt.insertRow(id, []int{colindex}, []ColumnValue{val}, opts)
+	return id
+}
+
+// InsertRow inserts values of the columns by names with the single new ID
+func (dt *DataTable) InsertRow(values map[string]ColumnValue, opts QueryOptions) (IDEntry, error) {
+	return dt.InsertRowAt(NewIDEntry, values, opts)
+}
+
+// InsertRowAt inserts values of the columns by names with the same ID, NewIDEntry allocates the next ID.
+// All columns of the row are locked together, so readers of any column see either old or new row.
+// Columns absent in values are not changed. With INSERT_UPDATE existing values are replaced.
+func (dt *DataTable) InsertRowAt(id IDEntry, values map[string]ColumnValue, opts QueryOptions) (IDEntry, error) {
+	idxs := make([]int, 0, len(values))
+	for name := range values {
+		colidx, ok := dt.names[name]
+		if !ok {
+			return id, ErrColumnNotFound
+		}
+		idxs = append(idxs, colidx)
+	}
+	// блокируем всегда в порядке индексов колонок
+	sort.Ints(idxs)
+	vals := make([]ColumnValue, len(idxs))
+	for i, colidx := range idxs {
+		vals[i] = values[dt.metadata[colidx].Name]
+	}
+	return dt.insertRow(id, idxs, vals, opts)
+}
+
+// insertRow sets vals to the columns with ascending indexes idxs
+func (dt *DataTable) insertRow(id IDEntry, idxs []int, vals []ColumnValue, opts QueryOptions) (IDEntry, error) {
 	if id == NewIDEntry {
-		id = col.maxId + 1
+		id = dt.newID()
+	} else {
+		dt.useID(id)
 	}
-	col.SetVal(id, val, opts&INSERT_UPDATE != 0, opts&INSERT_ASYNC != 0)
-	col.Unlock()
-	return id
+	upd, async := opts&INSERT_UPDATE != 0, opts&INSERT_ASYNC != 0
+
+	dt.walmu.RLock()
+	defer dt.walmu.RUnlock()
+	if dt.closed {
+		return id, ErrTableClosed
+	}
+
+	if async {
+		// в очередь ставим без блокировки, воркер колонки сам ее блокирует
+		if dt.wal != nil {
+			if err := dt.wal.logInsert(id, idxs, vals, opts); err != nil {
+				return id, err
+			}
+		}
+		for i, colidx := range idxs {
+			dt.columns[colidx].SetVal(id, vals[i], upd, true)
+		}
+		return id, nil
+	}
+
+	for _, colidx := range idxs {
+		dt.columns[colidx].Lock()
+	}
+	defer func() {
+		for _, colidx := range idxs {
+			dt.columns[colidx].Unlock()
+		}
+	}()
+
+	// пишем в WAL под блокировкой колонок, чтобы читатели не увидели строку раньше записи в лог
+	if dt.wal != nil {
+		if err := dt.wal.logInsert(id, idxs, vals, opts); err != nil {
+			return id, err
+		}
+	}
+
+	for i, colidx := range idxs {
+		dt.columns[colidx].SetVal(id, vals[i], upd, false)
+	}
+	return id, nil
+}
+
+// Flush waits until all INSERT_ASYNC writes queued before the call are applied
+func (dt *DataTable) Flush() error {
+	dt.walmu.RLock()
+	defer dt.walmu.RUnlock()
+	if dt.closed {
+		return ErrTableClosed
+	}
+	dt.flush()
+	return nil
+}
+
+// flush must be called under walmu
+func (dt *DataTable) flush() {
+	for _, col := range dt.columns {
+		col.Sync()
+	}
+}
+
+// DeleteRow removes values of id from all columns
+func (dt *DataTable) DeleteRow(id IDEntry) error {
+	dt.walmu.RLock()
+	defer dt.walmu.RUnlock()
+	if dt.closed {
+		return ErrTableClosed
+	}
+	// ранее поставленные в очередь значения не должны появиться после удаления
+	dt.flush()
+
+	for _, col := range dt.columns {
+		col.Lock()
+	}
+	defer func() {
+		for _, col := range dt.columns {
+			col.Unlock()
+		}
+	}()
+
+	if dt.wal != nil {
+		if err := dt.wal.logDelete(id); err != nil {
+			return err
+		}
+	}
+	for _, col := range dt.columns {
+		col.Remove(id)
+	}
+	return nil
 }
 
+// Select returns iterator of IDs, which values are equal to where.
+// With SELECT_NEQ it returns IDs with any other nonzero value.
+// With SELECT_GT, SELECT_GTE, SELECT_LT, SELECT_LTE it returns IDs with nonzero values,
+// that satisfy the range by ColumnValue.Compare, where may be absent in the dictonary.
+// Returns nil, if nothing found.
+// The iterator reads a snapshot of the column, changes made after Select are not visible to it.
 func (dt *DataTable) Select(colindex int, where ColumnValue, opts QueryOptions) IDIterator {
 	col := dt.columns[colindex]
+
+	if opts.IsRange() {
+		vals := col.dict.SelectRange(where, opts)
+		if len(vals) == 0 {
+			return nil
+		}
+		filter := make([]DataEntry, len(vals))
+		for i, v := range vals {
+			filter[i] = DataEntry(v)
+		}
+
+		col.RLock()
+		iter := col.IteratorWithFilterVals(filter, opts&SELECT_DESC != 0)
+		col.RUnlock()
+
+		return iter
+	}
+
 	de, ok := col.dict.In(where)
 	if !ok {
 		return nil
 	}
 
 	col.RLock()
-
-	// TODO: lock in iterator
-
-	// TODO: GT/GTE/LT/LTE iterators
-
 	iter := col.IteratorWithFilterVal(DataEntry(de), opts&SELECT_DESC != 0, opts&SELECT_NEQ != 0)
 	col.RUnlock()
 
 	return iter
 }
 
+func (dt *DataTable) column(colname string) (*Column, error) {
+	colidx, ok := dt.names[colname]
+	if !ok {
+		return nil, ErrColumnNotFound
+	}
+	return dt.columns[colidx], nil
+}
+
+// ColumnType returns the type of the column by name
+func (dt *DataTable) ColumnType(colname string) (*ColumnType, error) {
+	colidx, ok := dt.names[colname]
+	if !ok {
+		return nil, ErrColumnNotFound
+	}
+	return dt.metadata[colidx], nil
+}
+
+// ColumnTypes returns types of all columns in the order of indexes, the result must not be modified
+func (dt *DataTable) ColumnTypes() []*ColumnType {
+	return dt.metadata
+}
+
 func (dt *DataTable) SelectN(colname string, where ColumnValue, opts QueryOptions) IDIterator {
 	colidx, ok := dt.names[colname]
 	if !ok {
@@ -74,7 +329,7 @@ func (dt *DataTable) Or(iters ...IDIterator) IDIterator {
 	if len(iters) == 0 {
 		return nil
 	}
-	return NewIteratorMerge(iters...)
+	return NewIteratorMerge(combineBits(combineRoaring(iters, false), false)...)
 }
 
 func (dt *DataTable) And(iters ...IDIterator) IDIterator {
@@ -82,7 +337,7 @@ func (dt *DataTable) And(iters ...IDIterator) IDIterator {
 		return nil
 	}
 	iter := NewIteratorIntersect(iters[0].Reversed())
-	for _, it := range iters {
+	for _, it := range combineBits(combineRoaring(iters, true), true) {
 		iter.Append(it)
 	}
 	return iter
@@ -92,6 +347,10 @@ func (dt *DataTable) Sub(iter IDIterator, diffIters ...IDIterator) IDIterator {
 	if iter == nil {
 		return nil
 	}
+	iter, diffIters, ok := subBits(iter, diffIters)
+	if ok && len(diffIters) == 0 {
+		return iter
+	}
 
 	var isec *IntersectIterator
 	if it, ok := iter.(*IntersectIterator); ok {
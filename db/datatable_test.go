@@ -0,0 +1,2266 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testUint uint64
+
+func (v testUint) Compare(o ColumnValue) int {
+	ov := o.(testUint)
+	switch {
+	case v < ov:
+		return -1
+	case v > ov:
+		return 1
+	}
+	return 0
+}
+
+type testInt int64
+
+func (v testInt) Compare(o ColumnValue) int {
+	ov := o.(testInt)
+	switch {
+	case v < ov:
+		return -1
+	case v > ov:
+		return 1
+	}
+	return 0
+}
+
+func collectIDs(iter IDIterator) []IDEntry {
+	var ret []IDEntry
+	if iter == nil {
+		return ret
+	}
+	for iter.HasNext() {
+		ret = append(ret, iter.NextID())
+	}
+	return ret
+}
+
+func equalIDs(a, b []IDEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSelectRange(t *testing.T) {
+	for _, uniq := range []int{2, 4, 16, 200, 1000} {
+		dt := &DataTable{}
+		col := dt.AddColumn(&ColumnType{
+			Name:         "v",
+			ZeroValue:    testInt(-1),
+			Lines:        100,
+			UniqueValues: uniq,
+		})
+		nvals := uniq - 1
+		if nvals > 10 {
+			nvals = 10
+		}
+		for id := IDEntry(1); id <= 50; id++ {
+			dt.Insert(col, id, testInt(int(id)%nvals), 0)
+		}
+
+		tests := []struct {
+			where testInt
+			opts  QueryOptions
+			f     func(v int) bool
+		}{
+			{0, SELECT_GT, func(v int) bool { return v > 0 }},
+			{0, SELECT_GTE, func(v int) bool { return v >= 0 }},
+			{1, SELECT_LT, func(v int) bool { return v < 1 }},
+			{1, SELECT_LTE, func(v int) bool { return v <= 1 }},
+			{100, SELECT_LT | SELECT_DESC, func(v int) bool { return v < 100 }},
+			{100, SELECT_GT, func(v int) bool { return false }},
+		}
+		for _, tt := range tests {
+			var want []IDEntry
+			for id := 1; id <= 50; id++ {
+				if tt.f(id % nvals) {
+					want = append(want, IDEntry(id))
+				}
+			}
+			if tt.opts&SELECT_DESC != 0 {
+				for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+					want[i], want[j] = want[j], want[i]
+				}
+			}
+			got := collectIDs(dt.Select(col, tt.where, tt.opts))
+			if !equalIDs(got, want) {
+				t.Errorf("uniq %d, where %d, opts %d: got %v, want %v", uniq, tt.where, tt.opts, got, want)
+			}
+		}
+	}
+}
+
+func TestOrderedValues(t *testing.T) {
+	dt := &DataTable{}
+	col := dt.AddColumn(&ColumnType{
+		Name:         "v",
+		ZeroValue:    testInt(-1),
+		Lines:        100,
+		UniqueValues: 1000,
+	})
+	vals := []testInt{50, 10, 30, 20, 40, 10, 60}
+	for i, v := range vals {
+		dt.Insert(col, IDEntry(i+1), v, 0)
+	}
+
+	c := dt.columns[col]
+	var got []testInt
+	start, _ := c.InDictonary(testInt(20))
+	c.IterateVUp(start, func(v DataEntry, ids []IDEntry) bool {
+		got = append(got, c.FromDictonary(v).(testInt))
+		return true
+	})
+	if want := []testInt{20, 30, 40, 50, 60}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("IterateVUp: got %v, want %v", got, want)
+	}
+
+	got = got[:0]
+	start, _ = c.InDictonary(testInt(40))
+	c.IterateVDown(start, func(v DataEntry, ids []IDEntry) bool {
+		got = append(got, c.FromDictonary(v).(testInt))
+		return len(got) < 3
+	})
+	if want := []testInt{40, 30, 20}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("IterateVDown: got %v, want %v", got, want)
+	}
+
+	if v, ok := c.MinVal(); !ok || c.FromDictonary(v) != testInt(10) {
+		t.Errorf("MinVal: got %v", c.FromDictonary(v))
+	}
+	if v, ok := c.MaxVal(); !ok || c.FromDictonary(v) != testInt(60) {
+		t.Errorf("MaxVal: got %v", c.FromDictonary(v))
+	}
+
+	want := []IDEntry{1, 3, 5, 7}
+	if got := collectIDs(dt.Select(col, testInt(25), SELECT_GT)); !equalIDs(got, want) {
+		t.Errorf("Select GT: got %v, want %v", got, want)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	gob.Register(testInt(0))
+
+	dct := NewDictonary(100)
+	orders, customers := &DataTable{}, &DataTable{}
+	for _, dt := range []*DataTable{orders, customers} {
+		dt.AddColumn(&ColumnType{
+			Name:         "customer",
+			ZeroValue:    testInt(0),
+			Lines:        100,
+			UniqueValues: 100,
+			Dictonary:    dct,
+		})
+	}
+	// колонки со списками ID соединяются по корзинам, пустое значение второй колонки - 2
+	bucketed := []*DataTable{{}, {}}
+	for i, dt := range bucketed {
+		dt.AddColumn(&ColumnType{
+			Name:         "customer",
+			ZeroValue:    testInt(2 * i),
+			Lines:        100,
+			UniqueValues: 1000,
+			Dictonary:    dct,
+		})
+	}
+	hashed := &DataTable{}
+	hashed.AddColumn(&ColumnType{
+		Name:         "customer",
+		ZeroValue:    testInt(0),
+		Lines:        100,
+		UniqueValues: 4,
+	})
+	for id := IDEntry(1); id <= 3; id++ {
+		customers.Insert(0, id, testInt(id), 0)
+		hashed.Insert(0, id, testInt(id), 0)
+	}
+	for id := IDEntry(1); id <= 6; id++ {
+		orders.Insert(0, id, testInt(id%4), 0)
+		for _, dt := range bucketed {
+			dt.Insert(0, id, testInt(id%4), 0)
+		}
+	}
+
+	want := "[{1 1} {5 1} {2 2} {6 2} {3 3}]"
+	res, err := JoinOn(orders, "customer", customers, "customer")
+	if err != nil || fmt.Sprint(res) != want {
+		t.Errorf("merge join: got %v, %v, want %v", res, err, want)
+	}
+	res, err = HashJoin(orders, "customer", customers, "customer")
+	if err != nil || fmt.Sprint(res) != want {
+		t.Errorf("hash join: got %v, %v, want %v", res, err, want)
+	}
+	res, err = JoinOn(orders, "customer", hashed, "customer")
+	if err != nil || fmt.Sprint(res) != want {
+		t.Errorf("hash join with bitmap column: got %v, %v, want %v", res, err, want)
+	}
+	if _, err := MergeJoin(orders, "customer", hashed, "customer"); err != ErrDifferentDictonaries {
+		t.Errorf("merge join of different dictonaries: got %v", err)
+	}
+
+	// пустые значения обеих колонок не соединяются
+	want = "[{1 1} {1 5} {5 1} {5 5} {3 3}]"
+	for _, pair := range [][2]*DataTable{{bucketed[0], bucketed[1]}, {bucketed[1], bucketed[0]}, {orders, bucketed[1]}} {
+		res, err = JoinOn(pair[0], "customer", pair[1], "customer")
+		if err != nil || fmt.Sprint(res) != want {
+			t.Errorf("merge join with empty values: got %v, %v, want %v", res, err, want)
+		}
+	}
+
+	// сжатые списки соединяются без копирования колонок, снимок списков не меняется после вставки
+	long := []*DataTable{{}, {}}
+	for _, dt := range long {
+		dt.AddColumn(&ColumnType{Name: "customer", ZeroValue: testInt(0), Lines: 200, UniqueValues: 1000, Dictonary: dct})
+	}
+	for id := IDEntry(1); id <= 150; id++ {
+		long[0].Insert(0, id, testInt(id%2+1), 0)
+	}
+	long[1].Insert(0, 1, testInt(1), 0)
+	long[1].Insert(0, 2, testInt(3), 0)
+	col := long[0].columns[0]
+	if col.posting(col.ToDictonary(testInt(1))).bm == nil {
+		t.Fatal("long posting list is not compressed")
+	}
+	view := col.valuesView()
+	long[0].Insert(0, 152, testInt(1), 0)
+	res, err = JoinOn(long[0], "customer", long[1], "customer")
+	if err != nil || len(res) != 76 || res[0] != (JoinPair{2, 1}) || res[75] != (JoinPair{152, 1}) {
+		t.Errorf("merge join of compressed lists: got %d pairs, %v", len(res), err)
+	}
+	bck, rem := remFunc(uint32(col.ToDictonary(testInt(1))), col.bucketsCount)
+	for _, ve := range view[bck] {
+		if ve.rem == rem && ve.length() != 75 {
+			t.Errorf("view of compressed list is changed: %d IDs", ve.length())
+		}
+	}
+
+	// общий словарь снимков разных таблиц загружается общим,
+	// значение 20 из второго снимка получает другой индекс, т.к. первая таблица уже добавила 10
+	var snaps [2]bytes.Buffer
+	if _, err := orders.WriteTo(&snaps[0]); err != nil {
+		t.Fatal(err)
+	}
+	customers.Insert(0, 4, testInt(20), 0)
+	if _, err := customers.WriteTo(&snaps[1]); err != nil {
+		t.Fatal(err)
+	}
+	dicts := make(map[uint64]*Dictonary)
+	orders2, err := ReadDataTableShared(&snaps[0], dicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders2.Insert(0, 7, testInt(10), 0)
+	orders2.Insert(0, 8, testInt(20), 0)
+	customers2, err := ReadDataTableShared(&snaps[1], dicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orders2.metadata[0].Dictonary == nil || orders2.metadata[0].Dictonary != customers2.metadata[0].Dictonary {
+		t.Errorf("shared dictonary is not restored")
+	}
+	if got := collectIDs(customers2.SelectN("customer", testInt(20), 0)); fmt.Sprint(got) != "[4]" {
+		t.Errorf("remapped column: got %v", got)
+	}
+	want = "[{1 1} {5 1} {2 2} {6 2} {3 3} {8 4}]"
+	res, err = MergeJoin(orders2, "customer", customers2, "customer")
+	if err != nil || fmt.Sprint(res) != want {
+		t.Errorf("merge join of loaded tables: got %v, %v, want %v", res, err, want)
+	}
+}
+
+func TestInsertRow(t *testing.T) {
+	dt := &DataTable{}
+	for _, name := range []string{"a", "b", "c"} {
+		dt.AddColumn(&ColumnType{
+			Name:         name,
+			ZeroValue:    testInt(0),
+			Lines:        100,
+			UniqueValues: 100,
+		})
+	}
+	id1, err := dt.InsertRow(map[string]ColumnValue{"a": testInt(1), "b": testInt(2)}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := dt.InsertRow(map[string]ColumnValue{"b": testInt(3), "c": testInt(4)}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == id2 {
+		t.Fatalf("same IDs for different rows: %d", id1)
+	}
+	if _, err := dt.InsertRowAt(id1, map[string]ColumnValue{"b": testInt(5)}, INSERT_UPDATE); err != nil {
+		t.Fatal(err)
+	}
+	if v := dt.columns[1].GetVal(id1); v != testInt(5) {
+		t.Errorf("updated value: got %v", v)
+	}
+	if got := collectIDs(dt.SelectN("b", testInt(2), 0)); len(got) != 0 {
+		t.Errorf("old value is still selected: %v", got)
+	}
+	if v := dt.columns[2].GetVal(id2); v != testInt(4) {
+		t.Errorf("value: got %v", v)
+	}
+	if _, err := dt.InsertRow(map[string]ColumnValue{"x": testInt(1)}, 0); err != ErrColumnNotFound {
+		t.Errorf("unknown column: got %v", err)
+	}
+}
+
+func TestDeleteRow(t *testing.T) {
+	dt := &DataTable{}
+	for i, uniq := range []int{2, 4, 16, 200, 1000} {
+		dt.AddColumn(&ColumnType{
+			Name:         fmt.Sprint("c", i),
+			ZeroValue:    testInt(1),
+			Lines:        100,
+			UniqueValues: uniq,
+		})
+	}
+	for id := IDEntry(1); id <= 10; id++ {
+		for col := range dt.columns {
+			dt.Insert(col, id, testInt(int(id)%2), 0)
+		}
+	}
+	dt.DeleteRow(1)
+	dt.DeleteRow(4)
+	dt.DeleteRow(10)
+
+	for col, c := range dt.columns {
+		if got := collectIDs(dt.Select(col, testInt(0), 0)); fmt.Sprint(got) != "[2 6 8]" {
+			t.Errorf("column %d: select after delete: got %v", col, got)
+		}
+		if got := collectIDs(dt.Select(col, testInt(1), SELECT_LT|SELECT_DESC)); fmt.Sprint(got) != "[8 6 2]" {
+			t.Errorf("column %d: range select after delete: got %v", col, got)
+		}
+		if v := c.GetVal(4); v != nil {
+			t.Errorf("column %d: deleted value: got %v", col, v)
+		}
+		if c.minId != 2 || c.maxId != 9 {
+			t.Errorf("column %d: bounds after delete: %d, %d", col, c.minId, c.maxId)
+		}
+		if cnt := c.GetCountV(c.ToDictonary(testInt(0))); cnt != 3 {
+			t.Errorf("column %d: count after delete: %d", col, cnt)
+		}
+	}
+
+	dt.Insert(0, 4, testInt(0), 0)
+	if got := collectIDs(dt.Select(0, testInt(0), 0)); fmt.Sprint(got) != "[2 4 6 8]" {
+		t.Errorf("select after reinsert: got %v", got)
+	}
+
+	// строка 15 есть только в первой колонке, в остальных это пропуск между 9 и 20
+	row := make(map[string]ColumnValue)
+	for col := range dt.columns {
+		row[fmt.Sprint("c", col)] = testInt(0)
+	}
+	dt.InsertRowAt(20, row, 0)
+	dt.InsertRowAt(15, map[string]ColumnValue{"c0": testInt(0)}, 0)
+	for _, id := range []IDEntry{15, 17, 30} {
+		if err := dt.DeleteRow(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for col, c := range dt.columns {
+		name := fmt.Sprint("c", col)
+		want := "[2 6 8 20]"
+		if col == 0 {
+			want = "[2 4 6 8 20]"
+		}
+		if got := collectIDs(dt.Select(col, testInt(0), 0)); fmt.Sprint(got) != want {
+			t.Errorf("column %d: select after delete of missing rows: got %v, want %s", col, got, want)
+		}
+		zeros, empties := c.GetCountV(c.ToDictonary(testInt(0))), c.GetCountV(c.ToDictonary(testInt(1)))
+		if int(zeros) != strings.Count(want, " ")+1 || empties != 4 {
+			t.Errorf("column %d: counts after delete of missing rows: %d, %d", col, zeros, empties)
+		}
+		if st, _ := dt.Stats(name); st.Rows != int(zeros+empties) {
+			t.Errorf("column %d: stats after delete of missing rows: %+v", col, st)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	gob.Register(testInt(0))
+
+	dct := NewDictonary(10)
+	dt := &DataTable{}
+	for i, uniq := range []int{2, 4, 16, 1000, 1000} {
+		ct := &ColumnType{
+			Name:         fmt.Sprint("c", i),
+			ZeroValue:    testInt(1),
+			Lines:        100,
+			UniqueValues: uniq,
+		}
+		if i >= 3 {
+			ct.Dictonary = dct
+		}
+		dt.AddColumn(ct)
+	}
+	for id := IDEntry(1); id <= 20; id++ {
+		for col := range dt.columns {
+			dt.Insert(col, id, testInt(int(id)%2), 0)
+		}
+	}
+	dt.Insert(3, 21, testInt(7), 0)
+	dt.DeleteRow(4)
+
+	var buf bytes.Buffer
+	n, err := dt.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo: %d bytes, %v", n, err)
+	}
+	// вход неизвестного размера читается потоком
+	if _, err := ReadDataTable(struct{ io.Reader }{bytes.NewReader(buf.Bytes())}); err != nil {
+		t.Errorf("stream: %v", err)
+	}
+	dt2, err := ReadDataTable(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for col := range dt.columns {
+		want := collectIDs(dt.Select(col, testInt(0), 0))
+		if got := collectIDs(dt2.Select(col, testInt(0), 0)); !equalIDs(got, want) {
+			t.Errorf("column %d: got %v, want %v", col, got, want)
+		}
+		if dt2.metadata[col].ZeroValue != testInt(1) {
+			t.Errorf("column %d: zero value %v", col, dt2.metadata[col].ZeroValue)
+		}
+	}
+	if dt2.metadata[3].Dictonary == nil || dt2.metadata[3].Dictonary != dt2.metadata[4].Dictonary {
+		t.Errorf("shared dictonary is not restored")
+	}
+	if got := collectIDs(dt2.Select(3, testInt(5), SELECT_GT)); fmt.Sprint(got) != "[21]" {
+		t.Errorf("range select: got %v", got)
+	}
+	if id := dt2.Insert(0, NewIDEntry, testInt(0), 0); id != 22 {
+		t.Errorf("new ID: got %d", id)
+	}
+
+	// длина больше остатка входа не выделяет память
+	buf.Reset()
+	sw := &snapWriter{w: bufio.NewWriter(&buf)}
+	sw.Write([]byte(snapshotMagic))
+	sw.u32(snapshotVersion)
+	sw.u8(valCodec)
+	sw.u32(0)
+	sw.u64(0)
+	sw.u32(1)
+	sw.u64(0)
+	sw.u32(1)
+	sw.value(IntValue(0))
+	sw.slice(1, []DictIndex{0})
+	sw.u32(1)
+	sw.str("a")
+	sw.u32(100)
+	sw.u32(1000)
+	sw.u32(0)
+	sw.u8(encVal)
+	sw.u32(0)
+	sw.u32(1)
+	sw.u32(0)
+	sw.u32(1)
+	sw.u32(1<<31 - 1)
+	if err := sw.w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	if _, err := ReadDataTable(&buf); err != ErrSnapshotFormat {
+		t.Errorf("corrupted length: got %v", err)
+	}
+	// в потоке длина не проверяется по размеру, но память выделяется по мере чтения
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := ReadDataTable(struct{ io.Reader }{bytes.NewReader(corrupted)}); err != io.ErrUnexpectedEOF {
+		t.Errorf("corrupted length of stream: got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 16*readChunk {
+		t.Errorf("corrupted length of stream: %d bytes allocated", n)
+	}
+}
+
+func TestWAL(t *testing.T) {
+	gob.Register(testInt(0))
+
+	dir := t.TempDir()
+	snap, log := dir+"/table.snap", dir+"/table.wal"
+
+	dt, err := OpenDataTable(snap, log, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := dt.AddColumn(&ColumnType{Name: "a", ZeroValue: testInt(0), Lines: 100, UniqueValues: 4})
+	dt.AddColumn(&ColumnType{Name: "b", ZeroValue: testInt(0), Lines: 100, UniqueValues: 100})
+	for i := 1; i <= 5; i++ {
+		dt.Insert(a, NewIDEntry, testInt(i%2+1), 0)
+	}
+	if _, err := dt.InsertRowAt(3, map[string]ColumnValue{"a": testInt(2), "b": testInt(30)}, INSERT_UPDATE); err != nil {
+		t.Fatal(err)
+	}
+	if err := dt.DeleteRow(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := dt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(dt *DataTable, wantA, wantB string) {
+		t.Helper()
+		if got := collectIDs(dt.SelectN("a", testInt(2), 0)); fmt.Sprint(got) != wantA {
+			t.Errorf("a: got %v, want %v", got, wantA)
+		}
+		if got := collectIDs(dt.SelectN("b", testInt(30), 0)); fmt.Sprint(got) != wantB {
+			t.Errorf("b: got %v, want %v", got, wantB)
+		}
+	}
+
+	dt, err = OpenDataTable(snap, log, WALOptions{Sync: SyncInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(dt, "[3 5]", "[3]")
+
+	if err := dt.Checkpoint(snap); err != nil {
+		t.Fatal(err)
+	}
+	dt.Insert(1, 7, testInt(30), 0)
+	dt.Close()
+
+	// недописанная запись в конце лога
+	f, err := os.OpenFile(log, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1, 2})
+	f.Close()
+
+	dt, err = OpenDataTable(snap, log, WALOptions{Sync: SyncNone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(dt, "[3 5]", "[3 7]")
+	if id := dt.Insert(0, NewIDEntry, testInt(2), 0); id != 8 {
+		t.Errorf("new ID: got %d", id)
+	}
+	dt.Close()
+
+	dt, err = OpenDataTable(snap, log, WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(dt, "[3 5 8]", "[3 7]")
+	if err := dt.DropColumn("a"); err != nil {
+		t.Fatal(err)
+	}
+	dt.Insert(0, 9, testInt(30), 0)
+	dt.Close()
+
+	dt, err = OpenDataTable(snap, log, WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dt.columns) != 1 || dt.metadata[0].Index != 0 {
+		t.Errorf("dropped column: %d columns", len(dt.columns))
+	}
+	if got := collectIDs(dt.SelectN("b", testInt(30), 0)); fmt.Sprint(got) != "[3 7 9]" {
+		t.Errorf("b after drop: got %v", got)
+	}
+	dt.Close()
+	// ошибка применения записи не пропускается
+	closed := &DataTable{}
+	closed.AddColumn(&ColumnType{Name: "a", ZeroValue: testInt(0), Lines: 100, UniqueValues: 4})
+	closed.AddColumn(&ColumnType{Name: "b", ZeroValue: testInt(0), Lines: 100, UniqueValues: 100})
+	closed.Close()
+	w, err := OpenWAL(log, WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Replay(closed); !errors.Is(err, ErrTableClosed) {
+		t.Errorf("replay to closed table: %v", err)
+	}
+	w.Close()
+}
+
+// legacyValue writes the value like snapshots before version 3 and logs without the format record
+func legacyValue(sw *snapWriter, v ColumnValue) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		sw.err = err
+		return
+	}
+	sw.u8(1)
+	sw.u32(uint32(buf.Len()))
+	sw.Write(buf.Bytes())
+}
+
+func TestLegacyFormat(t *testing.T) {
+	gob.Register(testInt(0))
+
+	dir := t.TempDir()
+	snap, log := dir+"/table.snap", dir+"/table.wal"
+
+	// снимок версии 2 с колонкой 1b: ID 1 со значением 5, ID 2 с нулевым
+	var buf bytes.Buffer
+	sw := &snapWriter{w: bufio.NewWriter(&buf)}
+	sw.Write([]byte(snapshotMagic))
+	sw.u32(2)
+	sw.u32(2)
+	sw.u64(0)
+	sw.u32(1)
+	sw.u32(2)
+	legacyValue(sw, testInt(0))
+	legacyValue(sw, testInt(5))
+	sw.slice(2, []DictIndex{0, 1})
+	sw.u32(1)
+	sw.str("a")
+	sw.u32(100)
+	sw.u32(2)
+	sw.u32(0)
+	sw.u8(enc1b)
+	sw.u32(0)
+	sw.u32(1)
+	sw.u32(2)
+	sw.slice(1, []uint64{2})
+	sw.slice(2, []int32{1, 1})
+	sw.slice(0, []uint64(nil))
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	if sw.err != nil {
+		t.Fatal(sw.err)
+	}
+	if err := os.WriteFile(snap, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// журнал без записи формата со вставкой ID 3
+	buf.Reset()
+	sw = &snapWriter{w: bufio.NewWriter(&buf)}
+	sw.u64(1)
+	sw.u8(walInsert)
+	sw.u32(3)
+	sw.u8(0)
+	sw.u32(1)
+	sw.u32(0)
+	legacyValue(sw, testInt(5))
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	if sw.err != nil {
+		t.Fatal(sw.err)
+	}
+	var hdr [8]byte
+	binary.LittleEndian.PutUint32(hdr[:4], uint32(buf.Len()))
+	binary.LittleEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(buf.Bytes()))
+	if err := os.WriteFile(log, append(hdr[:], buf.Bytes()...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(want string) {
+		t.Helper()
+		dt, err := OpenDataTable(snap, log, WALOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := collectIDs(dt.SelectN("a", testInt(5), 0)); fmt.Sprint(got) != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if v := dt.metadata[0].ZeroValue; v != testInt(0) {
+			t.Errorf("zero value: %v", v)
+		}
+		dt.Close()
+	}
+
+	check("[1 3]")
+
+	// новые записи дописываются в старый журнал после записи формата
+	dt, err := OpenDataTable(snap, log, WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.Insert(0, 4, testInt(5), 0)
+	dt.Close()
+	check("[1 3 4]")
+
+	dt, err = OpenDataTable(snap, log, WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dt.Checkpoint(snap); err != nil {
+		t.Fatal(err)
+	}
+	dt.Insert(0, 6, testInt(5), 0)
+	dt.Close()
+	check("[1 3 4 6]")
+}
+
+type testPoint struct {
+	X, Y int32
+}
+
+func (p testPoint) Compare(o ColumnValue) int {
+	op := o.(testPoint)
+	if c := IntValue(p.X).Compare(IntValue(op.X)); c != 0 {
+		return c
+	}
+	return IntValue(p.Y).Compare(IntValue(op.Y))
+}
+
+type testPointCodec struct{}
+
+func (testPointCodec) Tag() byte { return MinUserCodecTag }
+func (testPointCodec) AppendValue(dst []byte, v ColumnValue) []byte {
+	p := v.(testPoint)
+	return append(dst, byte(p.X), byte(p.Y))
+}
+func (testPointCodec) DecodeValue(src []byte) (ColumnValue, error) {
+	if len(src) != 2 {
+		return nil, ErrValueFormat
+	}
+	return testPoint{int32(src[0]), int32(src[1])}, nil
+}
+
+// otherPointCodec - кодек с другим тегом для уже зарегистрированных типов
+type otherPointCodec struct{ testPointCodec }
+
+func (otherPointCodec) Tag() byte { return MinUserCodecTag + 1 }
+
+// реестр кодеков глобальный, регистрируем один раз на весь пакет, чтобы тесты можно было повторять
+var errTestPointCodec = RegisterCodec(testPoint{}, testPointCodec{})
+
+func TestCodecs(t *testing.T) {
+	if errTestPointCodec != nil {
+		t.Fatal(errTestPointCodec)
+	}
+	if err := RegisterCodec(testPoint{}, testPointCodec{}); err != ErrCodecTag {
+		t.Errorf("second registration: got %v", err)
+	}
+	if err := RegisterCodec(testPoint{}, otherPointCodec{}); err != ErrCodecType {
+		t.Errorf("registration with another tag: got %v", err)
+	}
+	if err := RegisterCodec(IntValue(0), otherPointCodec{}); err != ErrCodecType {
+		t.Errorf("registration for built-in type: got %v", err)
+	}
+	if c, _ := CodecOf(IntValue(0)); c.Tag() != intCodecTag {
+		t.Errorf("built-in codec is replaced by tag %d", c.Tag())
+	}
+	gob.Register(testInt(0))
+
+	vals := []ColumnValue{
+		IntValue(-12345),
+		FloatValue(3.25),
+		StringValue("abc"),
+		BoolValue(true),
+		NewBytesValue([]byte{0, 1, 2}),
+		testTimeValue(t),
+		testPoint{3, 4},
+		testInt(7),
+	}
+	for _, want := range vals {
+		b, err := AppendValue(nil, want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := DecodeValue(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != want {
+			t.Errorf("got %v, want %v", v, want)
+		}
+	}
+}
+
+func testTimeValue(t *testing.T) ColumnValue {
+	ts := TimeStamp("1577836800")
+	if err := ts.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	v := ts.Value()
+	if s := v.String(); s != "2020-01-01T00:00:00Z" {
+		t.Errorf("time string: %s", s)
+	}
+	return v
+}
+
+func TestAsyncFlush(t *testing.T) {
+	dt := &DataTable{}
+	a := dt.AddColumn(&ColumnType{Name: "a", ZeroValue: testInt(0), Lines: 10000, UniqueValues: 4})
+	b := dt.AddColumn(&ColumnType{Name: "b", ZeroValue: testInt(0), Lines: 10000, UniqueValues: 100})
+	for i := 1; i <= 5000; i++ {
+		dt.InsertRow(map[string]ColumnValue{"a": testInt(i%3 + 1), "b": testInt(i % 50)}, INSERT_ASYNC)
+	}
+	dt.Insert(b, 10, testInt(77), INSERT_ASYNC|INSERT_UPDATE)
+	dt.Flush()
+
+	if got := collectIDs(dt.Select(a, testInt(1), 0)); len(got) != 1666 {
+		t.Errorf("a = 1: got %d IDs", len(got))
+	}
+	if got := collectIDs(dt.Select(b, testInt(77), 0)); fmt.Sprint(got) != "[10]" {
+		t.Errorf("updated value: got %v", got)
+	}
+	if got := collectIDs(dt.Select(b, testInt(10), 0)); len(got) != 99 {
+		t.Errorf("b = 10: got %d IDs", len(got))
+	}
+}
+
+func TestClosedTable(t *testing.T) {
+	dt := &DataTable{}
+	a := dt.AddColumn(&ColumnType{Name: "a", ZeroValue: testInt(0), Lines: 100, UniqueValues: 4})
+	dt.Insert(a, 1, testInt(1), 0)
+	tx := dt.Begin()
+	tx.Insert(a, 2, testInt(2), 0)
+	if err := dt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// изменения закрытой таблицы возвращают ошибку, а не паникуют на закрытой очереди колонки
+	dt.Insert(a, 3, testInt(1), INSERT_ASYNC)
+	if _, err := dt.InsertRowAt(4, map[string]ColumnValue{"a": testInt(1)}, INSERT_ASYNC); err != ErrTableClosed {
+		t.Errorf("insert: %v", err)
+	}
+	for name, f := range map[string]func() error{
+		"flush":      dt.Flush,
+		"delete":     func() error { return dt.DeleteRow(1) },
+		"commit":     tx.Commit,
+		"checkpoint": func() error { return dt.Checkpoint(t.TempDir() + "/table.snap") },
+		"drop":       func() error { return dt.DropColumn("a") },
+		"close":      dt.Close,
+	} {
+		if err := f(); err != ErrTableClosed {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	dt.columns[a].Sync()
+	dt.columns[a].Set(5, 1, false, true)
+}
+
+func TestSelectSnapshot(t *testing.T) {
+	dt := &DataTable{}
+	for i, uniq := range []int{4, 1000} {
+		dt.AddColumn(&ColumnType{
+			Name:         fmt.Sprint("c", i),
+			ZeroValue:    testInt(0),
+			Lines:        10000,
+			UniqueValues: uniq,
+		})
+	}
+	for id := IDEntry(1); id <= 2000; id++ {
+		dt.InsertRowAt(id, map[string]ColumnValue{"c0": testInt(1), "c1": testInt(1)}, 0)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			id := IDEntry(1 + (i*7919)%2000)
+			dt.DeleteRow(id)
+			dt.InsertRowAt(id, map[string]ColumnValue{"c0": testInt(1), "c1": testInt(1)}, 0)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		for col := range dt.columns {
+			iter := dt.Select(col, testInt(1), 0)
+			last := IDEntry(0)
+			for iter.HasNext() {
+				id := iter.NextID()
+				if id <= last {
+					t.Fatalf("column %d: ID %d after %d", col, id, last)
+				}
+				last = id
+			}
+		}
+	}
+	<-done
+}
+
+func TestTx(t *testing.T) {
+	gob.Register(testInt(0))
+
+	dir := t.TempDir()
+	snap, log := dir+"/table.snap", dir+"/table.wal"
+
+	dt, err := OpenDataTable(snap, log, WALOptions{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.AddColumn(&ColumnType{Name: "a", ZeroValue: testInt(0), Lines: 100, UniqueValues: 100})
+	dt.AddColumn(&ColumnType{Name: "b", ZeroValue: testInt(0), Lines: 100, UniqueValues: 100})
+	for i := 1; i <= 4; i++ {
+		dt.InsertRow(map[string]ColumnValue{"a": testInt(i % 2), "b": testInt(i)}, 0)
+	}
+
+	tx := dt.Begin()
+	id, err := tx.InsertRow(map[string]ColumnValue{"a": testInt(1), "b": testInt(5)}, 0)
+	if err != nil || id != 5 {
+		t.Fatalf("tx insert: %d, %v", id, err)
+	}
+	tx.InsertRowAt(3, map[string]ColumnValue{"a": testInt(2)}, INSERT_UPDATE)
+	tx.DeleteRow(1)
+
+	if got := collectIDs(dt.SelectN("a", testInt(1), 0)); fmt.Sprint(got) != "[1 3]" {
+		t.Errorf("table before commit: got %v", got)
+	}
+	if got := collectIDs(tx.SelectN("a", testInt(1), 0)); fmt.Sprint(got) != "[5]" {
+		t.Errorf("tx a=1: got %v", got)
+	}
+	if got := collectIDs(tx.SelectN("a", testInt(2), 0)); fmt.Sprint(got) != "[3]" {
+		t.Errorf("tx a=2: got %v", got)
+	}
+	if got := collectIDs(tx.SelectN("b", testInt(2), SELECT_GTE|SELECT_DESC)); fmt.Sprint(got) != "[5 4 3 2]" {
+		t.Errorf("tx b>=2: got %v", got)
+	}
+
+	rb := dt.Begin()
+	rb.DeleteRow(2)
+	rb.Rollback()
+	if err := rb.Commit(); err != ErrTxDone {
+		t.Errorf("commit after rollback: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.InsertRow(map[string]ColumnValue{"a": testInt(1)}, 0); err != ErrTxDone {
+		t.Errorf("insert after commit: %v", err)
+	}
+	dt.Close()
+
+	dt, err = OpenDataTable(snap, log, WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := collectIDs(dt.SelectN("a", testInt(1), 0)); fmt.Sprint(got) != "[5]" {
+		t.Errorf("a=1 after reopen: got %v", got)
+	}
+	if got := collectIDs(dt.SelectN("a", testInt(2), 0)); fmt.Sprint(got) != "[3]" {
+		t.Errorf("a=2 after reopen: got %v", got)
+	}
+	if got := collectIDs(dt.SelectN("b", testInt(0), SELECT_GT)); fmt.Sprint(got) != "[2 3 4 5]" {
+		t.Errorf("b after reopen: got %v", got)
+	}
+	dt.Close()
+}
+
+func TestAggregate(t *testing.T) {
+	dt := &DataTable{}
+	for _, uniq := range []int{2, 4, 16, 100, 1000} {
+		dt.AddColumn(&ColumnType{Name: fmt.Sprint("c", uniq), ZeroValue: IntValue(0), Lines: 300, UniqueValues: uniq})
+	}
+	for id := 1; id <= 300; id++ {
+		dt.InsertRow(map[string]ColumnValue{
+			"c2":    IntValue(id % 2),
+			"c4":    IntValue(id % 4),
+			"c16":   IntValue(id % 16),
+			"c100":  IntValue(id % 100),
+			"c1000": IntValue(id % 100),
+		}, 0)
+	}
+	for id := IDEntry(60); id <= 200; id += 7 {
+		dt.DeleteRow(id)
+	}
+
+	for _, uniq := range []int{2, 4, 16, 100, 1000} {
+		name := fmt.Sprint("c", uniq)
+		for _, opts := range []QueryOptions{0, SELECT_DESC, SELECT_GTE, SELECT_GTE | SELECT_DESC} {
+			iter := dt.SelectN(name, IntValue(1), opts)
+			want := collectIDs(iter.Clone())
+			if n := Count(iter); n != len(want) {
+				t.Errorf("%s %d: count %d, want %d", name, opts, n, len(want))
+			}
+			// частично пройденный итератор
+			for i := 0; i < 5; i++ {
+				iter.HasNext()
+			}
+			rest := len(want) - 5
+			if rest < 0 {
+				rest = 0
+			}
+			if n := Count(iter); n != rest {
+				t.Errorf("%s %d: count after 5 %d, want %d", name, opts, n, rest)
+			}
+
+			iter = dt.SelectN(name, IntValue(1), opts)
+			var sum int64
+			for _, id := range want {
+				sum += int64(dt.columns[dt.names[name]].GetVal(id).(IntValue))
+			}
+			if v, err := dt.Aggregate(iter, name, AGG_SUM); err != nil || v != IntValue(sum) {
+				t.Errorf("%s %d: sum %v %v, want %d", name, opts, v, err, sum)
+			}
+			if v, _ := dt.Aggregate(iter, name, AGG_COUNT); v != IntValue(len(want)) {
+				t.Errorf("%s %d: aggregate count %v, want %d", name, opts, v, len(want))
+			}
+		}
+	}
+
+	// подсчет по всем значениям биткарты за один проход
+	for _, name := range []string{"c16", "c100"} {
+		col := dt.columns[dt.names[name]]
+		iter := dt.SelectN(name, IntValue(3), SELECT_NEQ)
+		for i := 0; i < 5; i++ {
+			iter.HasNext()
+		}
+		want := make(map[DataEntry]int)
+		for _, id := range collectIDs(iter.Clone()) {
+			if v := col.Get(id); v != col.empty {
+				want[v]++
+			}
+		}
+		if got := col.tally(iter); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: tally %v, want %v", name, got, want)
+		}
+	}
+
+	iter := dt.SelectN("c4", IntValue(2), 0)
+	if v, _ := dt.Aggregate(iter, "c100", AGG_MIN); v != IntValue(2) {
+		t.Errorf("min: %v", v)
+	}
+	if v, _ := dt.Aggregate(iter, "c100", AGG_MAX); v != IntValue(98) {
+		t.Errorf("max: %v", v)
+	}
+	var sum16 int64
+	ids := collectIDs(iter.Clone())
+	for _, id := range ids {
+		sum16 += int64(id % 16)
+	}
+	if v, _ := dt.Aggregate(iter, "c16", AGG_AVG); v != FloatValue(float64(sum16)/float64(len(ids))) {
+		t.Errorf("avg: %v", v)
+	}
+	if v, _ := dt.Aggregate(nil, "c16", AGG_AVG); v != nil {
+		t.Errorf("avg of nothing: %v", v)
+	}
+	if _, err := dt.Aggregate(iter, "none", AGG_SUM); err != ErrColumnNotFound {
+		t.Errorf("unknown column: %v", err)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	dt := &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "city", ZeroValue: StringValue(""), Lines: 200, UniqueValues: 50})
+	dt.AddColumn(&ColumnType{Name: "kind", ZeroValue: IntValue(0), Lines: 200, UniqueValues: 4})
+	dt.AddColumn(&ColumnType{Name: "amount", ZeroValue: IntValue(0), Lines: 200, UniqueValues: 200})
+	for id := 1; id <= 200; id++ {
+		dt.InsertRow(map[string]ColumnValue{
+			"city":   StringValue(fmt.Sprint("c", id%5)),
+			"kind":   IntValue(id%3 + 1),
+			"amount": IntValue(id),
+		}, 0)
+	}
+	dt.DeleteRow(5)
+	dt.InsertRowAt(10, map[string]ColumnValue{"city": StringValue("")}, INSERT_UPDATE)
+
+	type key struct {
+		city string
+		kind int
+	}
+	sums := make(map[key]int)
+	cities := make(map[string]int)
+	iter := dt.SelectN("amount", IntValue(100), SELECT_LTE|SELECT_DESC)
+	for _, id := range collectIDs(iter.Clone()) {
+		if id == 5 || id == 10 {
+			continue
+		}
+		sums[key{fmt.Sprint("c", id%5), int(id%3 + 1)}] += int(id)
+		cities[fmt.Sprint("c", id%5)]++
+	}
+
+	groups, err := dt.GroupBy(iter, []string{"city"}, Agg{Func: AGG_COUNT}, Agg{Col: "amount", Func: AGG_MAX})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != len(cities) {
+		t.Fatalf("city groups: %v", groups)
+	}
+	for i, g := range groups {
+		city := string(g.Keys[0].(StringValue))
+		if city != fmt.Sprint("c", i) || g.Values[0] != IntValue(cities[city]) {
+			t.Errorf("city group %d: %v", i, g)
+		}
+	}
+	if groups[0].Values[1] != IntValue(100) || groups[4].Values[1] != IntValue(99) {
+		t.Errorf("max amount: %v, %v", groups[0], groups[4])
+	}
+
+	groups, err = dt.GroupBy(iter, []string{"kind", "city"}, Agg{Col: "amount", Func: AGG_SUM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != len(sums) {
+		t.Fatalf("kind, city groups: %d, want %d", len(groups), len(sums))
+	}
+	for i, g := range groups {
+		k := key{string(g.Keys[1].(StringValue)), int(g.Keys[0].(IntValue))}
+		if g.Values[0] != IntValue(sums[k]) {
+			t.Errorf("group %v: sum %v, want %d", k, g.Values[0], sums[k])
+		}
+		if i > 0 {
+			p := groups[i-1]
+			if c := p.Keys[0].Compare(g.Keys[0]); c > 0 || (c == 0 && p.Keys[1].Compare(g.Keys[1]) >= 0) {
+				t.Errorf("groups are not sorted: %v, %v", p, g)
+			}
+		}
+	}
+	// одна колонка со списками ID: длинные сжатые списки четных и нечетных ID до 150, остальные по одному ID
+	dt.AddColumn(&ColumnType{Name: "grp", ZeroValue: IntValue(-1), Lines: 200, UniqueValues: 300})
+	for id := IDEntry(1); id <= 200; id++ {
+		v := IntValue(id % 2)
+		if id > 150 {
+			v = IntValue(id)
+		}
+		dt.InsertRowAt(id, map[string]ColumnValue{"grp": v}, INSERT_UPDATE)
+	}
+	grp := dt.columns[dt.names["grp"]]
+	if !grp.useval || grp.posting(grp.ToDictonary(IntValue(0))).bm == nil {
+		t.Fatal("grp column must have compressed posting lists")
+	}
+	for _, it := range []IDIterator{iter, dt.SelectN("amount", IntValue(90), SELECT_GTE), dt.SelectN("amount", IntValue(20), SELECT_LTE)} {
+		want := make(map[IntValue]int)
+		for _, id := range collectIDs(it.Clone()) {
+			want[grp.GetVal(id).(IntValue)]++
+		}
+		groups, err := dt.GroupBy(it, []string{"grp"}, Agg{Func: AGG_COUNT})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != len(want) {
+			t.Errorf("grp groups: %d, want %d", len(groups), len(want))
+		}
+		for i, g := range groups {
+			v := g.Keys[0].(IntValue)
+			if g.Values[0] != IntValue(want[v]) || (i > 0 && groups[i-1].Keys[0].(IntValue) >= v) {
+				t.Errorf("grp group %d: %v, want count %d", i, g, want[v])
+			}
+		}
+	}
+
+	// группировка читает колонки под блокировкой и не выдает их данные итераторам
+	for _, name := range []string{"city", "kind", "grp"} {
+		if col := dt.columns[dt.names[name]]; atomic.LoadInt32(&col.shared) != 0 {
+			t.Errorf("column %s is shared", name)
+		}
+	}
+
+	if _, err := dt.GroupBy(iter, []string{"city"}, Agg{Col: "city", Func: AGG_SUM}); err != ErrNotNumeric {
+		t.Errorf("sum of strings: %v", err)
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	dt := &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "v", ZeroValue: IntValue(0), Lines: 100, UniqueValues: 30})
+	dt.AddColumn(&ColumnType{Name: "b", ZeroValue: IntValue(0), Lines: 100, UniqueValues: 4})
+	for id := 1; id <= 100; id++ {
+		dt.InsertRow(map[string]ColumnValue{"v": IntValue((id * 7) % 30), "b": IntValue(id%3 + 1)}, 0)
+	}
+
+	// ожидаемый порядок: по значению, затем по ID, пустые значения в конце
+	want := func(iter IDIterator, col string, desc bool) []IDEntry {
+		ids := sortedIDs(iter)
+		c := dt.columns[dt.names[col]]
+		sort.SliceStable(ids, func(i, j int) bool {
+			vi, vj := c.GetVal(ids[i]).(IntValue), c.GetVal(ids[j]).(IntValue)
+			if (vi == 0) != (vj == 0) {
+				return vj == 0
+			}
+			if vi != vj {
+				return (vi < vj) != desc
+			}
+			return (ids[i] < ids[j]) != desc
+		})
+		return ids
+	}
+
+	all := func() IDIterator { return dt.SelectN("b", IntValue(0), SELECT_NEQ) }
+	some := func() IDIterator { return dt.SelectN("b", IntValue(2), 0) }
+	for _, col := range []string{"v", "b"} {
+		for _, desc := range []bool{false, true} {
+			for _, sel := range []func() IDIterator{all, some} {
+				full := want(sel(), col, desc)
+				for _, lim := range [][2]int{{0, 0}, {5, 0}, {5, 10}, {0, 20}, {200, 3}} {
+					iter, err := dt.OrderBy(sel(), col, desc, lim[0], lim[1])
+					if err != nil {
+						t.Fatal(err)
+					}
+					exp := full[lim[1]:]
+					if lim[0] > 0 && lim[0] < len(exp) {
+						exp = exp[:lim[0]]
+					}
+					if got := collectIDs(iter); !equalIDs(got, exp) {
+						t.Errorf("%s desc=%v limit=%v: got %v, want %v", col, desc, lim, got, exp)
+					}
+				}
+			}
+		}
+	}
+
+	if iter, _ := dt.OrderBy(all(), "v", false, 10, 100); iter != nil {
+		t.Errorf("offset out of range: %v", collectIDs(iter))
+	}
+
+	// IDs в порядке значений не пересекаются и не сливаются
+	ordered, err := dt.OrderBy(all(), "v", false, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range map[string]func(){
+		"and": func() { dt.And(all(), ordered) },
+		"or":  func() { dt.Or(ordered, all()) },
+		"sub": func() { dt.Sub(all(), ordered) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s of OrderedIterator doesn't panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestFetch(t *testing.T) {
+	dt := &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "name", ZeroValue: StringValue(""), Lines: 600, UniqueValues: 600})
+	dt.AddColumn(&ColumnType{Name: "age", ZeroValue: IntValue(0), Lines: 600, UniqueValues: 100})
+	dt.AddColumn(&ColumnType{Name: "born", ZeroValue: TimeValue(0), Lines: 600, UniqueValues: 600})
+	for id := 1; id <= 600; id++ {
+		dt.InsertRow(map[string]ColumnValue{
+			"name": StringValue(fmt.Sprint("n", id)),
+			"age":  IntValue(id % 100),
+			"born": TimeValue(id * 1000),
+		}, 0)
+	}
+	dt.InsertRowAt(601, map[string]ColumnValue{"age": IntValue(1)}, 0)
+
+	rows := dt.Fetch(dt.SelectN("age", IntValue(1), 0), "age", "name")
+	n := 0
+	for rows.Next() {
+		n++
+		vals := rows.Values()
+		if vals[0] != IntValue(1) {
+			t.Errorf("row %d: %v", rows.ID(), vals)
+		}
+		if rows.ID() == 601 {
+			if vals[1] != nil {
+				t.Errorf("no value: %v", vals[1])
+			}
+		} else if vals[1] != StringValue(fmt.Sprint("n", rows.ID())) {
+			t.Errorf("row %d: %v", rows.ID(), vals)
+		}
+	}
+	if rows.Err() != nil || n != 7 {
+		t.Errorf("rows: %d, %v", n, rows.Err())
+	}
+
+	type person struct {
+		Name   string    `cmemdb:"name"`
+		Age    int64     `cmemdb:"age"`
+		Born   time.Time `cmemdb:"born"`
+		Hidden string    `cmemdb:"-"`
+	}
+	rows = dt.Fetch(dt.SelectN("age", IntValue(0), SELECT_NEQ))
+	n = 0
+	for rows.Next() {
+		var p person
+		if err := rows.Scan(&p); err != nil {
+			t.Fatal(err)
+		}
+		id := int64(rows.ID())
+		if id <= 600 && (p.Name != fmt.Sprint("n", id) || p.Age != id%100 || !p.Born.Equal(time.Unix(id*1000, 0))) {
+			t.Errorf("row %d: %+v", id, p)
+		}
+		n++
+	}
+	if n != 595 {
+		t.Errorf("scanned %d rows", n)
+	}
+
+	rows = dt.Fetch(dt.SelectN("age", IntValue(1), 0), "name")
+	rows.Next()
+	var bad struct {
+		Name int `cmemdb:"name"`
+	}
+	if err := rows.Scan(&bad); err != ErrScanValue {
+		t.Errorf("scan string to int: %v", err)
+	}
+	if rows := dt.Fetch(nil, "none"); rows.Next() || rows.Err() != ErrColumnNotFound {
+		t.Errorf("unknown column: %v", rows.Err())
+	}
+}
+
+func TestStructMapping(t *testing.T) {
+	type order struct {
+		ID      int       `cmemdb:"-"`
+		Client  string    `cmemdb:"client,lines=100,unique=20"`
+		Status  uint8     `cmemdb:"status,unique=4"`
+		Amount  float64   `cmemdb:",unique=100"`
+		Created time.Time `cmemdb:"created"`
+		Data    []byte
+		Point   testPoint
+		secret  string
+	}
+
+	dt, err := TableFor(&order{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ct := range dt.metadata {
+		names = append(names, ct.Name)
+	}
+	if fmt.Sprint(names) != "[client status Amount created Data Point]" {
+		t.Fatalf("columns: %v", names)
+	}
+	if ct := dt.metadata[0]; ct.Lines != 100 || ct.UniqueValues != 20 || ct.ZeroValue != StringValue("") {
+		t.Errorf("client column: %+v", ct)
+	}
+	if !dt.columns[1].use2b {
+		t.Errorf("status column is not 2 bit")
+	}
+
+	now := time.Unix(time.Now().Unix(), 0)
+	in := order{
+		Client:  "acme",
+		Status:  2,
+		Amount:  10.5,
+		Created: now,
+		Data:    []byte{1, 2},
+		Point:   testPoint{1, 2},
+		secret:  "x",
+	}
+	id, err := dt.InsertStruct(in, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.Client, in.Status = "other", 3
+	if _, err := dt.InsertStruct(&in, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var out order
+	if err := dt.ScanStruct(id, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Client != "acme" || out.Status != 2 || out.Amount != 10.5 || !out.Created.Equal(now) ||
+		!bytes.Equal(out.Data, []byte{1, 2}) || out.Point != (testPoint{1, 2}) || out.secret != "" {
+		t.Errorf("scanned: %+v", out)
+	}
+	if got := collectIDs(dt.SelectN("client", StringValue("other"), 0)); fmt.Sprint(got) != "[2]" {
+		t.Errorf("select by client: %v", got)
+	}
+	if err := dt.ScanStruct(10, &out); err != ErrRowNotFound {
+		t.Errorf("missing row: %v", err)
+	}
+
+	type bad struct {
+		C chan int
+	}
+	if _, err := TableFor(bad{}); err != ErrFieldType {
+		t.Errorf("chan field: %v", err)
+	}
+	type badTag struct {
+		A int `cmemdb:"a,size=1"`
+	}
+	if _, err := TableFor(badTag{}); err != ErrFieldTag {
+		t.Errorf("bad tag: %v", err)
+	}
+	type unsigned struct {
+		N uint64
+	}
+	udt, err := TableFor(unsigned{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := udt.InsertStruct(unsigned{math.MaxInt64}, 0); err != nil {
+		t.Errorf("max int64: %v", err)
+	}
+	if _, err := udt.InsertStruct(unsigned{math.MaxInt64 + 1}, 0); err != ErrUintRange {
+		t.Errorf("uint64 above max int64: %v", err)
+	}
+
+	// значения вне диапазона поля не усекаются при чтении
+	ndt := &DataTable{}
+	ndt.AddColumn(&ColumnType{Name: "n", ZeroValue: IntValue(0), Lines: 10, UniqueValues: 10})
+	ndt.AddColumn(&ColumnType{Name: "f", ZeroValue: FloatValue(0), Lines: 10, UniqueValues: 10})
+	ndt.InsertRowAt(1, map[string]ColumnValue{"n": IntValue(300), "f": FloatValue(1e300)}, 0)
+	ndt.InsertRowAt(2, map[string]ColumnValue{"n": IntValue(-1), "f": FloatValue(1.5)}, 0)
+	var small struct {
+		N uint8 `cmemdb:"n"`
+	}
+	if err := ndt.ScanStruct(1, &small); err != ErrScanValue {
+		t.Errorf("300 to uint8: %v, %d", err, small.N)
+	}
+	var uns struct {
+		N uint `cmemdb:"n"`
+	}
+	if err := ndt.ScanStruct(2, &uns); err != ErrScanValue {
+		t.Errorf("-1 to uint: %v, %d", err, uns.N)
+	}
+	var fits struct {
+		N int16   `cmemdb:"n"`
+		F float32 `cmemdb:"f"`
+	}
+	if err := ndt.ScanStruct(2, &fits); err != nil || fits.N != -1 || fits.F != 1.5 {
+		t.Errorf("fitting values: %v, %+v", err, fits)
+	}
+	if err := ndt.ScanStruct(1, &fits); err != ErrScanValue {
+		t.Errorf("1e300 to float32: %v, %+v", err, fits)
+	}
+	var big struct {
+		N int8
+	}
+	if err := udt.ScanStruct(1, &big); err != ErrScanValue {
+		t.Errorf("max int64 to int8: %v", err)
+	}
+	udt.AddColumn(&ColumnType{Name: "U", ZeroValue: testUint(0), Lines: 10, UniqueValues: 10})
+	udt.Insert(1, 1, testUint(math.MaxUint64), 0)
+	var wide struct {
+		U int64
+	}
+	if err := udt.ScanStruct(1, &wide); err != ErrUintRange {
+		t.Errorf("max uint64 to int64: %v", err)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	dt := &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "a", ZeroValue: IntValue(0), Lines: 100, UniqueValues: 4})
+	dt.AddColumn(&ColumnType{Name: "b", ZeroValue: IntValue(0), Lines: 100, UniqueValues: 1000})
+	for id := 1; id <= 100; id++ {
+		dt.InsertRow(map[string]ColumnValue{"a": IntValue(id%10/9 + 1), "b": IntValue(id % 20)}, 0)
+	}
+
+	for _, c := range []struct {
+		col   string
+		where ColumnValue
+		opts  QueryOptions
+	}{
+		{"a", IntValue(2), 0},
+		{"a", IntValue(2), SELECT_NEQ},
+		{"a", IntValue(1), SELECT_GTE},
+		{"b", IntValue(3), 0},
+		{"b", IntValue(3), SELECT_NEQ},
+		{"b", IntValue(15), SELECT_GT},
+	} {
+		iter := dt.SelectN(c.col, c.where, c.opts)
+		n := len(collectIDs(iter.Clone()))
+		if est := dt.Estimate(dt.names[c.col], c.where, c.opts); est != n {
+			t.Errorf("%s %v %d: estimate %d, want %d", c.col, c.where, c.opts, est, n)
+		}
+		if c.col == "a" && int(iter.Cardinality()) != n {
+			t.Errorf("%s %v %d: cardinality %d, want %d", c.col, c.where, c.opts, iter.Cardinality(), n)
+		}
+	}
+
+	st, err := dt.Stats("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Rows != 100 || st.Empty != 5 || st.Distinct != 20 || st.MinID != 1 || st.MaxID != 100 || st.Bits != 0 {
+		t.Errorf("stats: %+v", st)
+	}
+}
+
+func TestCardinality(t *testing.T) {
+	dt := &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "a", ZeroValue: IntValue(0), Lines: 100, UniqueValues: 4})
+	dt.AddColumn(&ColumnType{Name: "b", ZeroValue: IntValue(0), Lines: 100, UniqueValues: 100})
+	for id := 1; id <= 100; id++ {
+		dt.InsertRow(map[string]ColumnValue{"a": IntValue(id%10/9 + 1), "b": IntValue(id % 20)}, 0)
+	}
+
+	a2 := func() IDIterator { return dt.SelectN("a", IntValue(2), 0) }
+	b := func(v int, opts QueryOptions) IDIterator { return dt.SelectN("b", IntValue(v), opts) }
+	ordered, err := dt.OrderBy(b(10, SELECT_GT), "b", true, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name  string
+		iter  IDIterator
+		exact bool // оценка совпадает с количеством
+	}{
+		{"a = 2", a2(), true},
+		{"a != 2", dt.SelectN("a", IntValue(2), SELECT_NEQ), true},
+		{"b = 3", b(3, 0), true},
+		{"b > 10", b(10, SELECT_GT), true},
+		{"b = 3 or b = 4", dt.Or(b(3, 0), b(4, 0)), true},
+		{"a = 2 and b != 3", dt.And(a2(), b(3, SELECT_NEQ)), false},
+		{"b > 10 except a = 2", dt.Sub(b(10, SELECT_GT), a2()), false},
+		{"order by b", ordered, true},
+	} {
+		n := len(collectIDs(c.iter.Clone()))
+		if cnt := c.iter.ExactCount(); cnt != n {
+			t.Errorf("%s: exact count %d, want %d", c.name, cnt, n)
+		}
+		est := c.iter.EstimatedCardinality()
+		if c.exact && est != n {
+			t.Errorf("%s: estimate %d, want %d", c.name, est, n)
+		}
+		if est < 0 || est > 100 {
+			t.Errorf("%s: estimate %d out of the table", c.name, est)
+		}
+
+		for i := 0; i < 3 && c.iter.HasNext(); i++ {
+			n--
+		}
+		if cnt := c.iter.ExactCount(); cnt != n {
+			t.Errorf("%s: exact count after 3 IDs %d, want %d", c.name, cnt, n)
+		}
+		if cnt := Count(c.iter); cnt != n {
+			t.Errorf("%s: count after 3 IDs %d, want %d", c.name, cnt, n)
+		}
+	}
+
+	// HasNext в конце списка сдвигает позицию за границу
+	for _, reverse := range []bool{false, true} {
+		iter := NewIteratorByIds([]IDEntry{1, 2, 3}, reverse)
+		for i := 0; i < 5; i++ {
+			iter.HasNext()
+		}
+		if cnt := iter.ExactCount(); cnt != 0 {
+			t.Errorf("list reverse=%v: exact count at the end %d", reverse, cnt)
+		}
+	}
+}
+
+func TestIntersectClone(t *testing.T) {
+	dt := &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "a", ZeroValue: IntValue(0), Lines: 100, UniqueValues: 4})
+	dt.AddColumn(&ColumnType{Name: "b", ZeroValue: IntValue(0), Lines: 100, UniqueValues: 100})
+	for id := 1; id <= 50; id++ {
+		dt.InsertRow(map[string]ColumnValue{"a": IntValue(id%2 + 1), "b": IntValue(id % 5)}, 0)
+	}
+
+	for name, iter := range map[string]IDIterator{
+		"and": dt.And(dt.SelectN("a", IntValue(1), 0), dt.SelectN("b", IntValue(0), SELECT_NEQ)),
+		"sub": dt.Sub(dt.SelectN("a", IntValue(1), 0), dt.SelectN("b", IntValue(0), 0)),
+	} {
+		// клон, пройденный до конца, не сдвигает итераторы оригинала
+		want := collectIDs(iter.Clone())
+		if len(want) != 20 {
+			t.Errorf("%s: clone got %v", name, want)
+		}
+		if got := collectIDs(iter); !equalIDs(got, want) {
+			t.Errorf("%s: got %v after clone, want %v", name, got, want)
+		}
+	}
+}
+
+func TestRoaring(t *testing.T) {
+	const n = 300000
+	dt := &DataTable{}
+	a := dt.AddColumn(&ColumnType{Name: "a", ZeroValue: IntValue(0), Lines: n, UniqueValues: 1000})
+	b := dt.AddColumn(&ColumnType{Name: "b", ZeroValue: IntValue(0), Lines: n, UniqueValues: 1000})
+	rnd := rand.New(rand.NewSource(1))
+	vals := map[int]map[IDEntry]int64{a: {}, b: {}}
+	set := func(col int, id IDEntry, v int64) {
+		dt.Insert(col, id, IntValue(v), INSERT_UPDATE)
+		vals[col][id] = v
+	}
+	for id := IDEntry(1); id < n; id++ {
+		switch {
+		case id <= 100000:
+			set(a, id, 1) // отрезки
+		case id%3 == 0:
+			set(a, id, 2) // биткарты
+		case rnd.Intn(100) == 0:
+			set(a, id, 3) // массивы
+		}
+		if rnd.Intn(4) == 0 {
+			set(b, id, int64(1+id%7))
+		}
+	}
+	want := func(col int, match func(v int64) bool) []IDEntry {
+		var ret []IDEntry
+		for id, v := range vals[col] {
+			if match(v) {
+				ret = append(ret, id)
+			}
+		}
+		sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+		return ret
+	}
+	eq := func(x int64) func(int64) bool { return func(v int64) bool { return v == x } }
+
+	check := func(stage string) {
+		for _, v := range []int64{1, 2, 3} {
+			w := want(a, eq(v))
+			iter := dt.Select(a, IntValue(v), 0)
+			if _, ok := iter.(*RoaringIterator); !ok {
+				t.Fatalf("%s %d: %T, want compressed list", stage, v, iter)
+			}
+			if got := collectIDs(iter.Clone()); !equalIDs(got, w) {
+				t.Errorf("%s %d: got %d IDs, want %d", stage, v, len(got), len(w))
+			}
+			if cnt, est := iter.ExactCount(), iter.EstimatedCardinality(); cnt != len(w) || est != len(w) {
+				t.Errorf("%s %d: count %d, estimate %d, want %d", stage, v, cnt, est, len(w))
+			}
+			rev := collectIDs(dt.Select(a, IntValue(v), SELECT_DESC))
+			sort.Slice(rev, func(i, j int) bool { return rev[i] < rev[j] })
+			if !equalIDs(rev, w) {
+				t.Errorf("%s %d: reversed got %d IDs, want %d", stage, v, len(rev), len(w))
+			}
+
+			for i := 0; i < 200; i++ {
+				id := IDEntry(rnd.Intn(n + 10))
+				it := dt.Select(a, IntValue(v), 0)
+				k := sort.Search(len(w), func(i int) bool { return w[i] >= id })
+				if ok := it.JumpTo(id); ok != (k < len(w)) || ok && it.NextID() != w[k] {
+					t.Fatalf("%s %d: JumpTo(%d) %v %d", stage, v, id, ok, it.NextID())
+				}
+				if k+1 < len(w) && (!it.HasNext() || it.NextID() != w[k+1]) {
+					t.Fatalf("%s %d: next after JumpTo(%d) %d, want %d", stage, v, id, it.NextID(), w[k+1])
+				}
+				if k < len(w) && it.ExactCount() != len(w)-k-2 && k+1 < len(w) {
+					t.Fatalf("%s %d: count after JumpTo(%d) %d, want %d", stage, v, id, it.ExactCount(), len(w)-k-2)
+				}
+
+				it = dt.Select(a, IntValue(v), SELECT_DESC)
+				k = sort.Search(len(w), func(i int) bool { return w[i] > id }) - 1
+				if ok := it.JumpTo(id); ok != (k >= 0) || ok && it.NextID() != w[k] {
+					t.Fatalf("%s %d: reversed JumpTo(%d) %v %d", stage, v, id, ok, it.NextID())
+				}
+				if k > 0 && (!it.HasNext() || it.NextID() != w[k-1]) {
+					t.Fatalf("%s %d: reversed next after JumpTo(%d) %d, want %d", stage, v, id, it.NextID(), w[k-1])
+				}
+			}
+		}
+
+		or := dt.Or(dt.Select(a, IntValue(2), 0), dt.Select(a, IntValue(3), 0))
+		w := want(a, func(v int64) bool { return v == 2 || v == 3 })
+		if got := collectIDs(or.Clone()); !equalIDs(got, w) || Count(or) != len(w) {
+			t.Errorf("%s: or got %d IDs, count %d, want %d", stage, len(got), Count(or), len(w))
+		}
+
+		var and []IDEntry
+		for _, id := range want(a, eq(2)) {
+			if vals[b][id] == 3 {
+				and = append(and, id)
+			}
+		}
+		for _, opts := range []QueryOptions{0, SELECT_DESC} {
+			got := collectIDs(dt.And(dt.Select(a, IntValue(2), opts), dt.Select(b, IntValue(3), opts)))
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !equalIDs(got, and) {
+				t.Errorf("%s %d: and got %d IDs, want %d", stage, opts, len(got), len(and))
+			}
+		}
+	}
+	check("insert")
+
+	// итератор не видит изменений, сделанных после его создания
+	held := dt.Select(a, IntValue(1), 0)
+	before := want(a, eq(1))
+	done := make(chan []IDEntry)
+	go func() {
+		done <- collectIDs(held.Clone())
+	}()
+	for id := IDEntry(1); id <= 100000; id += 10 {
+		set(a, id, 3)
+	}
+	for id := IDEntry(99); id < n; id += 1000 {
+		if err := dt.DeleteRow(id); err != nil {
+			t.Fatal(err)
+		}
+		delete(vals[a], id)
+		delete(vals[b], id)
+	}
+	if got := <-done; !equalIDs(got, before) {
+		t.Errorf("concurrent iterator got %d IDs, want %d", len(got), len(before))
+	}
+	if got := collectIDs(held); !equalIDs(got, before) {
+		t.Errorf("held iterator got %d IDs, want %d", len(got), len(before))
+	}
+	check("update")
+
+	// короткий список снова хранится слайсом
+	col := dt.columns[a]
+	for id := IDEntry(1); id <= roaringMinIDs; id++ {
+		set(a, id, 4)
+	}
+	v4, _ := col.InDictonary(IntValue(4))
+	if ve := col.posting(v4); ve == nil || ve.bm == nil {
+		t.Errorf("%d IDs are not compressed", roaringMinIDs)
+	}
+	for id := IDEntry(1); id <= roaringMinIDs-10; id++ {
+		set(a, id, 5)
+	}
+	if ve := col.posting(v4); ve == nil || ve.bm != nil || !equalIDs(ve.ids, want(a, eq(4))) {
+		t.Errorf("short list: %+v", ve)
+	}
+
+	var buf bytes.Buffer
+	if _, err := dt.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dt2, err := ReadDataTable(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter := dt2.Select(a, IntValue(2), 0)
+	if _, ok := iter.(*RoaringIterator); !ok || !equalIDs(collectIDs(iter), want(a, eq(2))) {
+		t.Errorf("snapshot: %T", iter)
+	}
+}
+
+func TestRoaringContainers(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	// множества ID разной плотности в нескольких контейнерах
+	gen := func() []IDEntry {
+		var ret []IDEntry
+		for key := uint32(0); key < 3; key++ {
+			switch rnd.Intn(4) {
+			case 0: // массив
+				for i := 0; i < 500; i++ {
+					ret = append(ret, IDEntry(key<<16|uint32(rnd.Intn(1<<16))))
+				}
+			case 1: // биткарта
+				for i := 0; i < 30000; i++ {
+					ret = append(ret, IDEntry(key<<16|uint32(rnd.Intn(1<<16))))
+				}
+			case 2: // отрезки
+				for r := 0; r < 20; r++ {
+					lo := rnd.Intn(1 << 16)
+					for l := lo; l < lo+rnd.Intn(3000) && l < 1<<16; l++ {
+						ret = append(ret, IDEntry(key<<16|uint32(l)))
+					}
+				}
+			}
+		}
+		sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+		uniq := ret[:0]
+		for i, id := range ret {
+			if i == 0 || ret[i-1] != id {
+				uniq = append(uniq, id)
+			}
+		}
+		return uniq
+	}
+	members := func(ids []IDEntry) map[IDEntry]bool {
+		ret := make(map[IDEntry]bool, len(ids))
+		for _, id := range ids {
+			ret[id] = true
+		}
+		return ret
+	}
+
+	for i := 0; i < 30; i++ {
+		x, y := gen(), gen()
+		mx, my := members(x), members(y)
+		var and, or []IDEntry
+		for id := IDEntry(0); id < 3<<16; id++ {
+			if mx[id] && my[id] {
+				and = append(and, id)
+			}
+			if mx[id] || my[id] {
+				or = append(or, id)
+			}
+		}
+		bx, by := newRoaring(x, 0), newRoaring(y, 0)
+		if got := bx.appendIDs(nil); !equalIDs(got, x) {
+			t.Fatalf("%d: got %d IDs, want %d", i, len(got), len(x))
+		}
+		if got := andRoaring(bx, by); !equalIDs(got.appendIDs(nil), and) || got.n != len(and) {
+			t.Errorf("%d: and got %d IDs, want %d", i, got.n, len(and))
+		}
+		if got := orRoaring(bx, by); !equalIDs(got.appendIDs(nil), or) || got.n != len(or) {
+			t.Errorf("%d: or got %d IDs, want %d", i, got.n, len(or))
+		}
+
+		// счетчики обратного итератора
+		it := newRoaringIterator(nil, bx, true)
+		for k := len(x) - 1; k >= 0; k-- {
+			if !it.HasNext() || it.NextID() != x[k] || it.ExactCount() != k {
+				t.Fatalf("%d: reversed %d at %d, count %d", i, it.NextID(), k, it.ExactCount())
+			}
+		}
+		if it.HasNext() || it.ExactCount() != 0 {
+			t.Errorf("%d: reversed iterator is not done", i)
+		}
+
+		// изменения на месте в своей эпохе и копия для следующей
+		owned := bx.own(1)
+		for _, id := range y {
+			owned.add(id, 1)
+		}
+		for _, id := range x {
+			owned.remove(id, 1)
+		}
+		var sub []IDEntry
+		for _, id := range y {
+			if !mx[id] {
+				sub = append(sub, id)
+			}
+		}
+		if got := owned.appendIDs(nil); !equalIDs(got, sub) || owned.n != len(sub) {
+			t.Errorf("%d: changed list got %d IDs, want %d", i, len(got), len(sub))
+		}
+		if got := bx.appendIDs(nil); !equalIDs(got, x) {
+			t.Errorf("%d: changes are visible in the previous epoch", i)
+		}
+	}
+
+	// эпоха не переполняется: список эпохи 0 копируется и через 2^32 эпох
+	bm := newRoaring([]IDEntry{1, 2, 3}, 0)
+	owned := bm.own(1 << 32)
+	owned.add(4, 1<<32)
+	owned.remove(1, 1<<32)
+	if got := bm.appendIDs(nil); !equalIDs(got, []IDEntry{1, 2, 3}) {
+		t.Errorf("changes are visible after 2^32 epochs: %v", got)
+	}
+	var ch chunks
+	*ch.at(0, 0) = 1
+	words := ch[0].words
+	*ch.at(0, 1<<32) = 2
+	if words[0] != 1 || ch[0].words[0] != 2 {
+		t.Errorf("chunk is changed in place after 2^32 epochs")
+	}
+}
+
+func TestBitset(t *testing.T) {
+	const n = 5000
+	dt := &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "flag", ZeroValue: IntValue(0), Lines: n, UniqueValues: 2})
+	dt.AddColumn(&ColumnType{Name: "st", ZeroValue: IntValue(0), Lines: n, UniqueValues: 4})
+	dt.AddColumn(&ColumnType{Name: "k", ZeroValue: IntValue(0), Lines: n, UniqueValues: 16})
+	dt.AddColumn(&ColumnType{Name: "u", ZeroValue: IntValue(0), Lines: n, UniqueValues: 1000})
+	rnd := rand.New(rand.NewSource(3))
+	rows := make(map[IDEntry]map[string]int64)
+	for i := 0; i < n-10; i++ {
+		row := map[string]int64{
+			"flag": rnd.Int63n(2),
+			"st":   rnd.Int63n(4),
+			"k":    rnd.Int63n(16),
+			"u":    rnd.Int63n(50),
+		}
+		vals := make(map[string]ColumnValue)
+		for c, v := range row {
+			// пропуски значений в части колонок
+			if i > 100 && rnd.Intn(10) == 0 {
+				delete(row, c)
+				continue
+			}
+			vals[c] = IntValue(v)
+		}
+		id, err := dt.InsertRow(vals, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows[id] = row
+	}
+	for id := IDEntry(3); id < n; id += 97 {
+		if err := dt.DeleteRow(id); err != nil {
+			t.Fatal(err)
+		}
+		delete(rows, id)
+	}
+
+	type pred struct {
+		col  string
+		v    int64
+		opts QueryOptions
+	}
+	// как Select: для 1 и 2 бит SELECT_NEQ включает пустые значения, для 4 бит - нет
+	match := func(p pred, id IDEntry) bool {
+		v, ok := rows[id][p.col]
+		if p.opts&SELECT_NEQ == 0 {
+			return ok && v == p.v
+		}
+		if p.col == "k" || p.col == "u" {
+			return ok && v != p.v && v != 0
+		}
+		return ok && v != p.v
+	}
+	sel := func(p pred, desc bool) IDIterator {
+		opts := p.opts
+		if desc {
+			opts |= SELECT_DESC
+		}
+		return dt.SelectN(p.col, IntValue(p.v), opts)
+	}
+	ids := func(iter IDIterator) []IDEntry {
+		ret := collectIDs(iter)
+		sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+		return ret
+	}
+	// ожидаемые ID берем у самих итераторов Select, они совпадают с построчной проверкой
+	selected := func(p pred) map[IDEntry]bool {
+		ret := make(map[IDEntry]bool)
+		for _, id := range collectIDs(sel(p, false)) {
+			ret[id] = true
+		}
+		return ret
+	}
+
+	preds := []pred{
+		{"flag", 1, 0}, {"flag", 1, SELECT_NEQ}, {"flag", 0, 0},
+		{"st", 2, 0}, {"st", 3, SELECT_NEQ},
+		{"k", 7, 0}, {"k", 7, SELECT_NEQ},
+		{"u", 5, 0},
+	}
+	for _, p := range preds {
+		sp := selected(p)
+		for id := IDEntry(0); id <= n; id++ {
+			if sp[id] != match(p, id) {
+				t.Fatalf("%v: selected %d %v", p, id, sp[id])
+			}
+		}
+	}
+
+	for i := 0; i < 60; i++ {
+		a, b, c := preds[rnd.Intn(len(preds))], preds[rnd.Intn(len(preds))], preds[rnd.Intn(len(preds))]
+		sa, sb, sc := selected(a), selected(b), selected(c)
+		var and, or, sub []IDEntry
+		for id := IDEntry(0); id <= n; id++ {
+			if sa[id] && sb[id] {
+				and = append(and, id)
+			}
+			if sa[id] || sb[id] || sc[id] {
+				or = append(or, id)
+			}
+			if sa[id] && !sb[id] && !sc[id] {
+				sub = append(sub, id)
+			}
+		}
+		for _, desc := range []bool{false, true} {
+			iter := dt.And(sel(a, desc), sel(b, desc))
+			if got := ids(iter.Clone()); !equalIDs(got, and) || Count(iter) != len(and) {
+				t.Errorf("%v and %v desc %v: got %d IDs, count %d, want %d", a, b, desc, len(got), Count(iter), len(and))
+			}
+			iter = dt.Or(sel(a, desc), sel(b, desc), sel(c, desc))
+			if got := ids(iter.Clone()); !equalIDs(got, or) || Count(iter) != len(or) {
+				t.Errorf("%v or %v or %v desc %v: got %d IDs, want %d", a, b, c, desc, len(got), len(or))
+			}
+			iter = dt.Sub(sel(a, desc), sel(b, desc), sel(c, desc))
+			if got := ids(iter.Clone()); !equalIDs(got, sub) || Count(iter) != len(sub) {
+				t.Errorf("%v except %v, %v desc %v: got %d IDs, want %d", a, b, c, desc, len(got), len(sub))
+			}
+			var andSub []IDEntry
+			for _, id := range and {
+				if !sc[id] {
+					andSub = append(andSub, id)
+				}
+			}
+			iter = dt.Sub(dt.And(sel(a, desc), sel(b, desc)), sel(c, desc))
+			if got := ids(iter.Clone()); !equalIDs(got, andSub) || Count(iter) != len(andSub) {
+				t.Errorf("(%v and %v) except %v desc %v: got %d IDs, want %d", a, b, c, desc, len(got), len(andSub))
+			}
+			if a.col != "u" && b.col != "u" && c.col != "u" {
+				if _, ok := iter.(*BitsetIterator); !ok {
+					t.Errorf("%v except %v, %v: %T, want bitset", a, b, c, iter)
+				}
+			}
+		}
+	}
+
+	// JumpTo и счетчики по набору бит
+	want := ids(dt.And(sel(preds[0], false), sel(preds[3], false)))
+	for _, desc := range []bool{false, true} {
+		for i := 0; i < 200; i++ {
+			id := IDEntry(rnd.Intn(n + 100))
+			iter := dt.And(sel(preds[0], desc), sel(preds[3], desc)).(*IntersectIterator).Iter(0)
+			if _, ok := iter.(*BitsetIterator); !ok {
+				t.Fatalf("%T, want bitset", iter)
+			}
+			k := sort.Search(len(want), func(i int) bool { return want[i] >= id })
+			next, rest := k, len(want)-k-1
+			if desc {
+				k = sort.Search(len(want), func(i int) bool { return want[i] > id }) - 1
+				next, rest = k, k
+			}
+			ok := iter.JumpTo(id)
+			if ok != (next >= 0 && next < len(want)) || ok && (iter.NextID() != want[next] || iter.ExactCount() != rest) {
+				t.Fatalf("desc %v: JumpTo(%d) %v %d, count %d", desc, id, ok, iter.NextID(), iter.ExactCount())
+			}
+		}
+	}
+}
+
+func TestUse8b(t *testing.T) {
+	const n = 3000
+	dt := &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "cat", ZeroValue: IntValue(0), Lines: n, UniqueValues: 200})
+	dt.AddColumn(&ColumnType{Name: "k", ZeroValue: IntValue(0), Lines: n, UniqueValues: 16})
+	rnd := rand.New(rand.NewSource(5))
+	rows := make(map[IDEntry]int64)
+	for id := IDEntry(1); id <= n; id++ {
+		// пропуски ID без значений
+		if rnd.Intn(20) == 0 {
+			continue
+		}
+		v := rnd.Int63n(200)
+		dt.InsertRowAt(id, map[string]ColumnValue{"cat": IntValue(v), "k": IntValue(v % 16)}, 0)
+		rows[id] = v
+	}
+	for id := IDEntry(5); id <= n; id += 41 {
+		dt.DeleteRow(id)
+		delete(rows, id)
+	}
+	c := dt.columns[0]
+	if !c.use8b {
+		t.Fatalf("column with 200 values is not use8b")
+	}
+	if st, _ := dt.Stats("cat"); st.Bits != 8 {
+		t.Errorf("stats: %+v", st)
+	}
+
+	for _, tt := range []struct {
+		v    int64
+		opts QueryOptions
+		f    func(v int64, ok bool) bool
+	}{
+		{77, 0, func(v int64, ok bool) bool { return ok && v == 77 }},
+		// SELECT_NEQ пропускает пустые значения, как для 4 бит
+		{77, SELECT_NEQ, func(v int64, ok bool) bool { return ok && v != 77 && v != 0 }},
+		{10, SELECT_GTE, func(v int64, ok bool) bool { return ok && v >= 10 }},
+		{150, SELECT_LT, func(v int64, ok bool) bool { return ok && v < 150 && v != 0 }},
+		{190, SELECT_GT, func(v int64, ok bool) bool { return ok && v > 190 }},
+	} {
+		var want []IDEntry
+		for id := IDEntry(1); id <= n; id++ {
+			v, ok := rows[id]
+			if tt.f(v, ok) {
+				want = append(want, id)
+			}
+		}
+		for _, desc := range []bool{false, true} {
+			opts := tt.opts
+			if desc {
+				opts |= SELECT_DESC
+			}
+			iter := dt.SelectN("cat", IntValue(tt.v), opts)
+			got := collectIDs(iter.Clone())
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !equalIDs(got, want) || Count(iter) != len(want) {
+				t.Errorf("%d %d: got %d IDs, count %d, want %d", tt.v, opts, len(got), Count(iter), len(want))
+				continue
+			}
+			id := IDEntry(n / 2)
+			k := sort.Search(len(want), func(i int) bool { return want[i] >= id })
+			if desc {
+				k = sort.Search(len(want), func(i int) bool { return want[i] > id }) - 1
+			}
+			if ok := iter.JumpTo(id); ok != (k >= 0 && k < len(want)) || ok && iter.NextID() != want[k] {
+				t.Errorf("%d %d: JumpTo(%d) %v %d", tt.v, opts, id, ok, iter.NextID())
+			}
+		}
+	}
+
+	// пересечение с колонкой 4 бит по словам
+	iter := dt.And(dt.SelectN("cat", IntValue(20), SELECT_GTE), dt.SelectN("k", IntValue(3), 0))
+	var want []IDEntry
+	for id := IDEntry(1); id <= n; id++ {
+		if v, ok := rows[id]; ok && v >= 20 && v%16 == 3 {
+			want = append(want, id)
+		}
+	}
+	if got := collectIDs(iter.Clone()); !equalIDs(got, want) || Count(iter) != len(want) {
+		t.Errorf("and: got %d IDs, want %d", len(got), len(want))
+	}
+	if it := iter.(*IntersectIterator).Iter(0); it == nil {
+		t.Errorf("and: no iterators")
+	} else if _, ok := it.(*BitsetIterator); !ok {
+		t.Errorf("and: %T, want bitset", it)
+	}
+
+	var buf bytes.Buffer
+	if _, err := dt.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dt2, err := ReadDataTable(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, v := range rows {
+		if got := dt2.columns[0].GetVal(id); got != IntValue(v) {
+			t.Fatalf("snapshot: %d = %v, want %d", id, got, v)
+		}
+	}
+	if !dt2.columns[0].use8b || dt2.columns[0].GetCountV(dt2.columns[0].ToDictonary(IntValue(77))) != c.GetCountV(c.ToDictonary(IntValue(77))) {
+		t.Errorf("snapshot: column is not restored")
+	}
+}
+
+func TestReencode(t *testing.T) {
+	const n = 1000
+	dt := &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "v", ZeroValue: IntValue(0), Lines: n, UniqueValues: 2})
+	c := dt.columns[0]
+	rows := make(map[IDEntry]int64)
+	check := func(stage string) {
+		t.Helper()
+		if st, _ := dt.Stats("v"); st.Rows != len(rows) {
+			t.Errorf("%s: rows %d, want %d", stage, st.Rows, len(rows))
+		}
+		for _, w := range []int64{0, 1, 3, 12, 100, 299} {
+			var want []IDEntry
+			for id := IDEntry(1); id <= n; id++ {
+				if v, ok := rows[id]; ok && v == w {
+					want = append(want, id)
+				}
+			}
+			iter := dt.SelectN("v", IntValue(w), 0)
+			if iter == nil {
+				if len(want) > 0 {
+					t.Errorf("%s: %d not found", stage, w)
+				}
+				continue
+			}
+			if got := collectIDs(iter); !equalIDs(got, want) {
+				t.Errorf("%s: %d got %d IDs, want %d", stage, w, len(got), len(want))
+			}
+			if cnt := c.GetCountV(c.ToDictonary(IntValue(w))); int(cnt) != len(want) {
+				t.Errorf("%s: count of %d %d, want %d", stage, w, cnt, len(want))
+			}
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(7))
+	var before IDIterator
+	var beforeIDs []IDEntry
+	for i, stage := range []struct {
+		vals int64
+		bits int
+	}{{2, 1}, {4, 2}, {16, 4}, {200, 8}, {300, 0}} {
+		for id := IDEntry(i%2 + 1); id <= n; id += 2 {
+			v := (int64(id/2) + rnd.Int63n(2)) % stage.vals
+			dt.Insert(0, id, IntValue(v), INSERT_UPDATE)
+			rows[id] = v
+		}
+		for id := IDEntry(i + 2); id <= n; id += 97 {
+			dt.DeleteRow(id)
+			delete(rows, id)
+		}
+		if st, _ := dt.Stats("v"); st.Bits != stage.bits {
+			t.Errorf("stage %d: bits %d, want %d", i, st.Bits, stage.bits)
+		}
+		check(fmt.Sprint("stage ", i))
+
+		// итератор, созданный до смены кодирования, читает прежние данные
+		if before != nil {
+			if got := collectIDs(before); !equalIDs(got, beforeIDs) {
+				t.Errorf("stage %d: iterator sees changes, got %d IDs, want %d", i, len(got), len(beforeIDs))
+			}
+		}
+		before = dt.SelectN("v", IntValue(1), 0)
+		beforeIDs = collectIDs(before.Clone())
+	}
+
+	// пропуски ID не становятся пустыми значениями в списках ID
+	dt = &DataTable{}
+	dt.AddColumn(&ColumnType{Name: "v", ZeroValue: IntValue(0), Lines: 100, UniqueValues: 2})
+	dt.Insert(0, 1, IntValue(0), 0)
+	dt.Insert(0, 10, IntValue(0), 0)
+	for v := int64(1); v <= 300; v++ {
+		dt.Insert(0, 50, IntValue(v), INSERT_UPDATE)
+	}
+	if st, _ := dt.Stats("v"); st.Bits != 0 || st.Rows != 3 {
+		t.Errorf("gaps after reencode: %+v", st)
+	}
+	if got := collectIDs(dt.SelectN("v", IntValue(0), 0)); fmt.Sprint(got) != "[1 10]" {
+		t.Errorf("gaps after reencode: zero value in %v", got)
+	}
+}
+
+func TestGrowBitmap(t *testing.T) {
+	const n = 140000
+	dt := &DataTable{}
+	for _, uniq := range []int{2, 4, 16, 200} {
+		dt.AddColumn(&ColumnType{Name: fmt.Sprint("c", uniq), ZeroValue: IntValue(0), Lines: 10, UniqueValues: uniq})
+	}
+	rows := make(map[IDEntry]int64)
+	for id := IDEntry(1); id <= n; id += 7 {
+		rows[id] = int64(id/7) % 2
+		vals := make(map[string]ColumnValue)
+		for _, uniq := range []int{2, 4, 16, 200} {
+			vals[fmt.Sprint("c", uniq)] = IntValue(rows[id])
+		}
+		if _, err := dt.InsertRowAt(id, vals, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := IDEntry(8); id <= n; id += 7 * 13 {
+		dt.DeleteRow(id)
+		delete(rows, id)
+	}
+
+	var want []IDEntry
+	for id := IDEntry(1); id <= n; id++ {
+		if v, ok := rows[id]; ok && v == 1 {
+			want = append(want, id)
+		}
+	}
+	for col, c := range dt.columns {
+		if len(c.bmp) < 2 {
+			t.Errorf("column %d: %d chunks", col, len(c.bmp))
+		}
+		iter := dt.Select(col, IntValue(1), 0)
+		if got := collectIDs(iter.Clone()); !equalIDs(got, want) || Count(iter) != len(want) {
+			t.Errorf("column %d: got %d IDs, count %d, want %d", col, len(got), Count(iter), len(want))
+		}
+		if c.Contains(n+100000) || !c.Contains(22) {
+			t.Errorf("column %d: Contains beyond the bitmap", col)
+		}
+	}
+
+	// итератор читает прежние куски, изменение копирует только свой кусок
+	c := dt.columns[3]
+	iter := dt.Select(3, IntValue(1), 0)
+	before := c.view()
+	dt.Insert(3, 1, IntValue(1), INSERT_UPDATE)
+	dt.Insert(3, n+10, IntValue(1), 0)
+	if got := collectIDs(iter); !equalIDs(got, want) {
+		t.Errorf("iterator sees changes: got %d IDs, want %d", len(got), len(want))
+	}
+	for k := range before.bmp {
+		// первый и последний куски изменены
+		same := &before.bmp[k].words[0] == &c.bmp[k].words[0]
+		if same == (k == 0 || k == len(before.bmp)-1) {
+			t.Errorf("chunk %d: copied %v", k, !same)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := dt.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dt2, err := ReadDataTable(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append([]IDEntry{1}, append(want, n+10)...)
+	if got := collectIDs(dt2.Select(3, IntValue(1), 0)); !equalIDs(got, want) {
+		t.Errorf("snapshot: got %d IDs, want %d", len(got), len(want))
+	}
+}
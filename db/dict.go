@@ -1,9 +1,15 @@
 package db
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sort"
 	"sync"
 )
 
+var ErrDifferentDictonaries = errors.New("columns have different dictonaries")
+
 type DictIndex uint32
 
 type Dictonary struct {
@@ -11,12 +17,26 @@ type Dictonary struct {
 
 	mm map[ColumnValue]DictIndex
 	ms []ColumnValue
+
+	// индекс значений, упорядоченный по ColumnValue.Compare
+	// пересортировывается лениво, только если значения добавлялись не по порядку
+	ord    []DictIndex
+	rank   []int32 // позиция в ord по DictIndex, -1 для удаленных
+	sorted bool
+
+	id uint64 // идентичность словаря в снимках разных таблиц, не 0
 }
 
 func NewDictonary(c int) *Dictonary {
+	var id [8]byte
+	crand.Read(id[:])
 	return &Dictonary{
-		mm: make(map[ColumnValue]DictIndex, c),
-		ms: make([]ColumnValue, 0, c),
+		mm:     make(map[ColumnValue]DictIndex, c),
+		ms:     make([]ColumnValue, 0, c),
+		ord:    make([]DictIndex, 0, c),
+		rank:   make([]int32, 0, c),
+		sorted: true,
+		id:     binary.LittleEndian.Uint64(id[:]) | 1,
 	}
 }
 
@@ -29,17 +49,59 @@ func (ld *Dictonary) Length() int {
 
 func (ld *Dictonary) Put(b ColumnValue) DictIndex {
 	ld.Lock()
+	i := ld.put(b)
+	ld.Unlock()
+	return i
+}
+
+// put must be called under write lock
+func (ld *Dictonary) put(b ColumnValue) DictIndex {
 	if i, ok := ld.mm[b]; ok {
-		ld.Unlock()
 		return i
 	}
 	i := len(ld.ms)
 	ld.ms = append(ld.ms, b)
 	ld.mm[b] = DictIndex(i)
-	ld.Unlock()
+	if ld.sorted && len(ld.ord) > 0 && ld.ms[ld.ord[len(ld.ord)-1]].Compare(b) > 0 {
+		ld.sorted = false
+	}
+	// слайсы ord и rank только дополняются, ранее выданные читателям части не меняются
+	ld.rank = append(ld.rank, int32(len(ld.ord)))
+	ld.ord = append(ld.ord, DictIndex(i))
 	return DictIndex(i)
 }
 
+// merge adds values of other copy of the dictonary, e.g. from snapshot of another table.
+// It returns indexes of values of o in ld, or nil if they are the same.
+func (ld *Dictonary) merge(o *Dictonary) []DictIndex {
+	ld.Lock()
+	defer ld.Unlock()
+
+	idx := make([]DictIndex, len(o.ms))
+	same := true
+	for i, v := range o.ms {
+		switch {
+		case i < len(ld.ms) && ld.ms[i] == v:
+			idx[i] = DictIndex(i)
+		case v == nil && i == len(ld.ms):
+			// удаленное значение занимает индекс
+			ld.ms = append(ld.ms, nil)
+			ld.rank = append(ld.rank, -1)
+			idx[i] = DictIndex(i)
+		case v == nil:
+			// удаленное значение не используется колонками
+			same = false
+		default:
+			idx[i] = ld.put(v)
+			same = same && idx[i] == DictIndex(i)
+		}
+	}
+	if same {
+		return nil
+	}
+	return idx
+}
+
 func (ld *Dictonary) In(b ColumnValue) (DictIndex, bool) {
 	ld.RLock()
 	if i, ok := ld.mm[b]; ok {
@@ -60,6 +122,135 @@ func (ld *Dictonary) Get(n DictIndex) ColumnValue {
 	return nil
 }
 
+// sortIndex rebuilds ord and rank in new slices, must be called under write lock
+func (ld *Dictonary) sortIndex() {
+	if ld.sorted {
+		return
+	}
+	ord := make([]DictIndex, 0, len(ld.ms))
+	for i, v := range ld.ms {
+		if v != nil {
+			ord = append(ord, DictIndex(i))
+		}
+	}
+	ms := ld.ms
+	sort.SliceStable(ord, func(i, j int) bool {
+		return ms[ord[i]].Compare(ms[ord[j]]) < 0
+	})
+	rank := make([]int32, len(ms), cap(ms))
+	for i := range rank {
+		rank[i] = -1
+	}
+	for i, n := range ord {
+		rank[n] = int32(i)
+	}
+	ld.ord, ld.rank = ord, rank
+	ld.sorted = true
+}
+
+// rlockSorted takes read lock with sorted ord and rank
+func (ld *Dictonary) rlockSorted() {
+	for {
+		ld.RLock()
+		if ld.sorted {
+			return
+		}
+		ld.RUnlock()
+		ld.Lock()
+		ld.sortIndex()
+		ld.Unlock()
+	}
+}
+
+// Ordered returns indexes of all values in ColumnValue.Compare order.
+// The result must not be modified.
+func (ld *Dictonary) Ordered() []DictIndex {
+	ld.rlockSorted()
+	ord := ld.ord
+	ld.RUnlock()
+	return ord
+}
+
+// Rank returns position of the value in Ordered, or -1 if there is no such value
+func (ld *Dictonary) Rank(n DictIndex) int {
+	ld.rlockSorted()
+	r := -1
+	if int(n) < len(ld.rank) {
+		r = int(ld.rank[n])
+	}
+	ld.RUnlock()
+	return r
+}
+
+// Ranks returns positions in Ordered for all indexes, -1 for deleted values.
+// Comparing ranks is the same as comparing values.
+// The result must not be modified.
+func (ld *Dictonary) Ranks() []int32 {
+	ld.rlockSorted()
+	rank := ld.rank
+	ld.RUnlock()
+	return rank
+}
+
+// position returns Ordered and position of n in it, -1 if there is no such value
+func (ld *Dictonary) position(n DictIndex) ([]DictIndex, int) {
+	ld.rlockSorted()
+	ord, r := ld.ord, -1
+	if int(n) < len(ld.rank) {
+		r = int(ld.rank[n])
+	}
+	ld.RUnlock()
+	return ord, r
+}
+
+func (ld *Dictonary) search(b ColumnValue) (int, int) {
+	ord, ms := ld.ord, ld.ms
+	lo := sort.Search(len(ord), func(i int) bool {
+		return ms[ord[i]].Compare(b) >= 0
+	})
+	hi := lo
+	for hi < len(ord) && ms[ord[hi]].Compare(b) == 0 {
+		hi++
+	}
+	return lo, hi
+}
+
+// Search returns positions in Ordered of the first value >= b and of the first value > b
+func (ld *Dictonary) Search(b ColumnValue) (int, int) {
+	ld.rlockSorted()
+	lo, hi := ld.search(b)
+	ld.RUnlock()
+	return lo, hi
+}
+
+// SelectRange returns indexes of all values satisfying range options against where, in Ordered order
+func (ld *Dictonary) SelectRange(where ColumnValue, opts QueryOptions) []DictIndex {
+	ld.rlockSorted()
+	defer ld.RUnlock()
+
+	lo, hi := ld.search(where)
+	ord := ld.ord
+	end := 0
+	if opts&SELECT_LTE != 0 {
+		end = hi
+	} else if opts&SELECT_LT != 0 {
+		end = lo
+	}
+	start := len(ord)
+	if opts&SELECT_GTE != 0 {
+		start = lo
+	} else if opts&SELECT_GT != 0 {
+		start = hi
+	}
+	if start < end {
+		start = end
+	}
+	ret := make([]DictIndex, 0, end+len(ord)-start)
+	ret = append(ret, ord[:end]...)
+	ret = append(ret, ord[start:]...)
+	return ret
+}
+
 func (ld *Dictonary) Compare(x, y DictIndex) int {
 	return ld.Get(x).Compare(ld.Get(y))
 }
@@ -72,6 +263,7 @@ func (ld *Dictonary) Delete(n DictIndex) {
 		if b != nil {
 			ld.ms[n] = nil
 			delete(ld.mm, b)
+			ld.sorted = false
 		}
 	}
 	ld.Unlock()
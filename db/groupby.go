@@ -0,0 +1,247 @@
+package db
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Agg is an aggregate calculated for each group by GroupBy.
+// AGG_COUNT with empty Col counts rows of the group.
+type Agg struct {
+	Col  string
+	Func AggFunc
+}
+
+// Group is a result row of GroupBy
+type Group struct {
+	Keys   []ColumnValue // значения keyCols
+	Values []ColumnValue // результаты aggs
+}
+
+// idGroup - ID одной группы
+type idGroup struct {
+	keys []DataEntry
+	ids  []IDEntry
+}
+
+// GroupBy groups IDs left in iter by values of keyCols and calculates aggs for each group like Aggregate.
+// Rows with an empty value in any of keyCols are skipped.
+// Groups are sorted by keys in ColumnValue.Compare order, iter is not advanced.
+func (dt *DataTable) GroupBy(iter IDIterator, keyCols []string, aggs ...Agg) ([]Group, error) {
+	keys := make([]*Column, len(keyCols))
+	for i, name := range keyCols {
+		col, err := dt.column(name)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = col
+	}
+	cols := make([]*Column, len(aggs))
+	for i, agg := range aggs {
+		if agg.Func > AGG_AVG {
+			return nil, ErrAggFunc
+		}
+		if agg.Col == "" && agg.Func == AGG_COUNT {
+			continue
+		}
+		col, err := dt.column(agg.Col)
+		if err != nil {
+			return nil, err
+		}
+		cols[i] = col
+	}
+
+	ids := sortedIDs(iter)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var groups []idGroup
+	ok := false
+	if len(keys) == 1 {
+		groups, ok = keys[0].groupVals(ids)
+	}
+	if !ok {
+		groups = groupTuples(keys, ids)
+	}
+
+	ret := make([]Group, len(groups))
+	for i, g := range groups {
+		ret[i].Keys = make([]ColumnValue, len(keys))
+		for k, v := range g.keys {
+			ret[i].Keys[k] = keys[k].FromDictonary(v)
+		}
+		ret[i].Values = make([]ColumnValue, len(aggs))
+		for j, agg := range aggs {
+			col := cols[j]
+			if col == nil {
+				ret[i].Values[j] = IntValue(len(g.ids))
+				continue
+			}
+			v, err := col.aggregate(col.tallyIDs(g.ids), agg.Func)
+			if err != nil {
+				return nil, err
+			}
+			ret[i].Values[j] = v
+		}
+	}
+	return ret, nil
+}
+
+// sortedIDs returns ascending IDs left in iter, iter is not advanced
+func sortedIDs(iter IDIterator) []IDEntry {
+	if iter == nil {
+		return nil
+	}
+	var ids []IDEntry
+	for it := iter.Clone(); it.HasNext(); {
+		ids = append(ids, it.NextID())
+	}
+	if iter.Reversed() {
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+	}
+	return ids
+}
+
+// valuesOf returns values of ids, NullEntry for IDs without value or with the empty value.
+// The data is read under the column lock and is not given to iterators, so writers don't copy it.
+func (c *Column) valuesOf(ids []IDEntry) []DataEntry {
+	ret := make([]DataEntry, len(ids))
+	c.RLock()
+	defer c.RUnlock()
+	for i, id := range ids {
+		ret[i] = NullEntry
+		if id > c.maxId {
+			continue
+		}
+		if v := c.Get(id); v != c.empty {
+			ret[i] = v
+		}
+	}
+	return ret
+}
+
+// tallyIDs counts not empty values of ids like tally
+func (c *Column) tallyIDs(ids []IDEntry) map[DataEntry]int {
+	ret := make(map[DataEntry]int)
+	for _, v := range c.valuesOf(ids) {
+		if v != NullEntry {
+			ret[v]++
+		}
+	}
+	return ret
+}
+
+// groupVals groups ascending ids by intersecting them with the posting lists in value order, false for bitmap columns.
+// The lists are read under the column lock and are not given to iterators, so writers don't copy them.
+func (c *Column) groupVals(ids []IDEntry) ([]idGroup, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.useval {
+		return nil, false
+	}
+	var ret []idGroup
+	for _, n := range c.dict.Ordered() {
+		v := DataEntry(n)
+		if v == c.empty {
+			continue
+		}
+		ve := c.posting(v)
+		if ve == nil {
+			continue
+		}
+		if gids := ve.intersect(ids); len(gids) > 0 {
+			ret = append(ret, idGroup{
+				keys: []DataEntry{v},
+				ids:  gids,
+			})
+		}
+	}
+	return ret, true
+}
+
+// intersect returns IDs of the list found in ascending ids, the shorter list is searched in the longer one
+func (ve *valEntry) intersect(ids []IDEntry) []IDEntry {
+	switch {
+	case ve.bm == nil && len(ve.ids) < len(ids):
+		return intersectIDs(ve.ids, ids)
+	case ve.bm == nil:
+		return intersectIDs(ids, ve.ids)
+	case ve.bm.n < len(ids):
+		return intersectIDs(ve.bm.appendIDs(make([]IDEntry, 0, ve.bm.n)), ids)
+	}
+	var ret []IDEntry
+	for _, id := range ids {
+		if ve.bm.contains(id) {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// intersectIDs returns IDs of ascending a found in ascending b by binary search
+func intersectIDs(a, b []IDEntry) []IDEntry {
+	var ret []IDEntry
+	for _, id := range a {
+		i := sort.Search(len(b), func(i int) bool { return b[i] >= id })
+		if i == len(b) {
+			break
+		}
+		if b[i] == id {
+			ret = append(ret, id)
+		}
+		b = b[i:]
+	}
+	return ret
+}
+
+// groupTuples groups ids by hashing tuples of values of the columns
+func groupTuples(keys []*Column, ids []IDEntry) []idGroup {
+	// колонки блокируются по одной
+	vals := make([][]DataEntry, len(keys))
+	for k, col := range keys {
+		vals[k] = col.valuesOf(ids)
+	}
+
+	var ret []idGroup
+	index := make(map[string]int)
+	tuple := make([]DataEntry, len(keys))
+	buf := make([]byte, 4*len(keys))
+lp:
+	for i, id := range ids {
+		for k := range keys {
+			v := vals[k][i]
+			if v == NullEntry {
+				continue lp
+			}
+			tuple[k] = v
+			binary.LittleEndian.PutUint32(buf[4*k:], uint32(v))
+		}
+		i, ok := index[string(buf)]
+		if !ok {
+			i = len(ret)
+			index[string(buf)] = i
+			ret = append(ret, idGroup{
+				keys: append([]DataEntry(nil), tuple...),
+			})
+		}
+		ret[i].ids = append(ret[i].ids, id)
+	}
+
+	ranks := make([][]int32, len(keys))
+	for k, col := range keys {
+		ranks[k] = col.dict.Ranks()
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		for k, rank := range ranks {
+			ri, rj := rank[ret[i].keys[k]], rank[ret[j].keys[k]]
+			if ri != rj {
+				return ri < rj
+			}
+		}
+		return false
+	})
+	return ret
+}
@@ -0,0 +1,140 @@
+package db
+
+// JoinPair is a pair of IDs from the left and the right tables with equal values in the joined columns
+type JoinPair struct {
+	Left  IDEntry
+	Right IDEntry
+}
+
+// JoinOn returns pairs of IDs where left.leftCol = right.rightCol.
+// Zero values are not joined. Pairs are grouped by value, IDs are ascending within a group.
+// Columns with the shared dictonary are joined by MergeJoin, others by HashJoin.
+func JoinOn(left *DataTable, leftCol string, right *DataTable, rightCol string) ([]JoinPair, error) {
+	lc, err := left.column(leftCol)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := right.column(rightCol)
+	if err != nil {
+		return nil, err
+	}
+	if lc.dict == rc.dict {
+		return mergeJoin(lc, rc), nil
+	}
+	return hashJoin(lc, rc), nil
+}
+
+// HashJoin joins columns by probing the dictonary of the column with more values
+// by values from the dictonary with less values.
+func HashJoin(left *DataTable, leftCol string, right *DataTable, rightCol string) ([]JoinPair, error) {
+	lc, err := left.column(leftCol)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := right.column(rightCol)
+	if err != nil {
+		return nil, err
+	}
+	return hashJoin(lc, rc), nil
+}
+
+// MergeJoin joins columns with the shared dictonary (see ColumnType.Dictonary) by DataEntry,
+// without decoding and hashing values.
+// Bucketed columns with equal buckets count are merged bucket by bucket, others are walked by the ordered dictonary.
+func MergeJoin(left *DataTable, leftCol string, right *DataTable, rightCol string) ([]JoinPair, error) {
+	lc, err := left.column(leftCol)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := right.column(rightCol)
+	if err != nil {
+		return nil, err
+	}
+	if lc.dict != rc.dict {
+		return nil, ErrDifferentDictonaries
+	}
+	return mergeJoin(lc, rc), nil
+}
+
+func appendJoinPairs(ret []JoinPair, lids, rids []IDEntry) []JoinPair {
+	for _, l := range lids {
+		for _, r := range rids {
+			ret = append(ret, JoinPair{l, r})
+		}
+	}
+	return ret
+}
+
+func hashJoin(lc, rc *Column) []JoinPair {
+	swap := lc.DictCardinality() > rc.DictCardinality()
+	if swap {
+		lc, rc = rc, lc
+	}
+	var ret []JoinPair
+	for _, n := range lc.dict.Ordered() {
+		lv := DataEntry(n)
+		if lv == lc.empty {
+			continue
+		}
+		val := lc.FromDictonary(lv)
+		if val == nil {
+			continue
+		}
+		rv, ok := rc.InDictonary(val)
+		if !ok || rv == rc.empty {
+			continue
+		}
+		lids := lc.idsOf(lv)
+		if len(lids) == 0 {
+			continue
+		}
+		rids := rc.idsOf(rv)
+		if swap {
+			ret = appendJoinPairs(ret, rids, lids)
+		} else {
+			ret = appendJoinPairs(ret, lids, rids)
+		}
+	}
+	return ret
+}
+
+func mergeJoin(lc, rc *Column) []JoinPair {
+	if lc.useval && rc.useval && lc.bucketsCount == rc.bucketsCount {
+		lvals, rvals := lc.valuesView(), rc.valuesView()
+		var ret []JoinPair
+		for b := range lvals {
+			lv, rv := lvals[b], rvals[b]
+			i, j := 0, 0
+			for i < len(lv) && j < len(rv) {
+				switch {
+				case lv[i].rem < rv[j].rem:
+					i++
+				case lv[i].rem > rv[j].rem:
+					j++
+				default:
+					// списки раскрываются только для совпавших значений
+					if v := DataEntry(valFunc(uint32(b), lv[i].rem, lc.bucketsCount)); v != lc.empty && v != rc.empty {
+						ret = appendJoinPairs(ret, lv[i].list(), rv[j].list())
+					}
+					i++
+					j++
+				}
+			}
+		}
+		return ret
+	}
+
+	var ret []JoinPair
+	for _, n := range lc.dict.Ordered() {
+		v := DataEntry(n)
+		if v == lc.empty || v == rc.empty {
+			continue
+		}
+		lids := lc.idsOf(v)
+		if len(lids) == 0 {
+			continue
+		}
+		ret = appendJoinPairs(ret, lids, rc.idsOf(v))
+	}
+	return ret
+}
@@ -12,3 +12,17 @@ const (
 	SELECT_GTE
 	SELECT_LTE
 )
+
+const selectRange = SELECT_GT | SELECT_LT | SELECT_GTE | SELECT_LTE
+
+func (opts QueryOptions) IsRange() bool {
+	return opts&selectRange != 0
+}
+
+// MatchRange reports whether cmp, the result of value.Compare(where), satisfies any of the range options
+func (opts QueryOptions) MatchRange(cmp int) bool {
+	return (opts&SELECT_GT != 0 && cmp > 0) ||
+		(opts&SELECT_GTE != 0 && cmp >= 0) ||
+		(opts&SELECT_LT != 0 && cmp < 0) ||
+		(opts&SELECT_LTE != 0 && cmp <= 0)
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"math"
+	"sort"
+)
+
+// OrderedIterator returns IDs in the order of column values made by OrderBy.
+// IDs are not ascending, so And, Or and Sub panic on it.
+type OrderedIterator struct {
+	ids      []IDEntry
+	pos      int
+	reversed bool
+	min, max IDEntry
+}
+
+func newOrderedIterator(ids []IDEntry, reversed bool) *OrderedIterator {
+	ret := &OrderedIterator{
+		ids:      ids,
+		pos:      -1,
+		reversed: reversed,
+	}
+	for i, id := range ids {
+		if i == 0 || id < ret.min {
+			ret.min = id
+		}
+		if i == 0 || id > ret.max {
+			ret.max = id
+		}
+	}
+	return ret
+}
+
+func (iter *OrderedIterator) Clone() IDIterator {
+	rv := &OrderedIterator{}
+	*rv = *iter
+	return rv
+}
+
+func (iter *OrderedIterator) Cardinality() int32 {
+	return int32(len(iter.ids))
+}
+
+func (iter *OrderedIterator) EstimatedCardinality() int {
+	return len(iter.ids)
+}
+
+func (iter *OrderedIterator) ExactCount() int {
+	if iter.pos >= len(iter.ids) {
+		return 0
+	}
+	return len(iter.ids) - iter.pos - 1
+}
+
+func (iter *OrderedIterator) Reversed() bool {
+	return iter.reversed
+}
+
+func (iter *OrderedIterator) Range() (IDEntry, IDEntry) {
+	return iter.min, iter.max
+}
+
+// JumpTo moves to id, if it is not returned yet
+func (iter *OrderedIterator) JumpTo(id IDEntry) bool {
+	if iter.pos >= 0 && iter.pos < len(iter.ids) && iter.ids[iter.pos] == id {
+		return true
+	}
+	for i := iter.pos + 1; i < len(iter.ids); i++ {
+		if iter.ids[i] == id {
+			iter.pos = i
+			return true
+		}
+	}
+	return false
+}
+
+func (iter *OrderedIterator) HasNext() bool {
+	if iter.pos < len(iter.ids) {
+		iter.pos++
+	}
+	return iter.pos < len(iter.ids)
+}
+
+func (iter *OrderedIterator) NextID() IDEntry {
+	if iter.pos >= 0 && iter.pos < len(iter.ids) {
+		return iter.ids[iter.pos]
+	}
+	return 0
+}
+
+// orderKey - позиция значения в порядке сортировки и ID
+type orderKey struct {
+	rank int32
+	id   IDEntry
+}
+
+func (a orderKey) less(b orderKey, desc bool) bool {
+	if a.rank != b.rank {
+		return (a.rank < b.rank) != desc
+	}
+	return (a.id < b.id) != desc
+}
+
+// orderHeap - куча, наверху последний по порядку ключ
+type orderHeap struct {
+	desc  bool
+	Elems []orderKey
+}
+
+func (h *orderHeap) Len() int           { return len(h.Elems) }
+func (h *orderHeap) Less(i, j int) bool { return h.Elems[j].less(h.Elems[i], h.desc) }
+func (h *orderHeap) Swap(i, j int)      { h.Elems[i], h.Elems[j] = h.Elems[j], h.Elems[i] }
+
+func pushOrderHeap(h *orderHeap, x orderKey) {
+	h.Elems = append(h.Elems, x)
+	j := h.Len() - 1
+	for {
+		i := (j - 1) / 2 // parent
+		if i == j || !h.Less(j, i) {
+			break
+		}
+		h.Swap(i, j)
+		j = i
+	}
+}
+
+func downOrderHeap(h *orderHeap, i, n int) {
+	for {
+		j1 := 2*i + 1
+		if j1 >= n || j1 < 0 { // j1 < 0 after int overflow
+			break
+		}
+		j := j1 // left child
+		if j2 := j1 + 1; j2 < n && h.Less(j2, j1) {
+			j = j2 // = 2*i + 2  // right child
+		}
+		if !h.Less(j, i) {
+			break
+		}
+		h.Swap(i, j)
+		i = j
+	}
+}
+
+// OrderBy returns IDs left in iter sorted by values of the column, equal values are sorted by ID.
+// IDs with empty values are placed last. limit <= 0 means all IDs after offset.
+// Returns nil, if there are no such IDs, iter is not advanced.
+func (dt *DataTable) OrderBy(iter IDIterator, colname string, desc bool, limit, offset int) (IDIterator, error) {
+	col, err := dt.column(colname)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	sel := sortedIDs(iter)
+	n := len(sel)
+	if offset >= n {
+		return nil, nil
+	}
+	k := n
+	if limit > 0 && offset+limit < n {
+		k = offset + limit
+	}
+
+	var ids []IDEntry
+	if !col.walkOrder(sel, desc, k, &ids) {
+		ids = col.sortOrder(sel, desc, k)
+	}
+	if len(ids) <= offset {
+		return nil, nil
+	}
+	return newOrderedIterator(ids[offset:], desc), nil
+}
+
+// walkOrder walks posting lists in value order, until k IDs are found.
+// It is used, if the walk is not longer than sorting of sel, false for bitmap columns.
+func (c *Column) walkOrder(sel []IDEntry, desc bool, k int, ids *[]IDEntry) bool {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.useval || c.maxId < c.minId {
+		return false
+	}
+	// ожидаемая длина обхода k * rows / n должна быть не больше n
+	rows := int64(c.maxId-c.minId) + 1
+	if int64(k)*rows > int64(len(sel))*int64(len(sel)) {
+		return false
+	}
+
+	ret := make([]IDEntry, 0, k)
+	found := make([]bool, len(sel))
+	f := func(v DataEntry, vids []IDEntry) bool {
+		if v == c.empty {
+			return true
+		}
+		start := len(ret)
+		for i, j := 0, 0; i < len(sel) && j < len(vids); {
+			switch {
+			case sel[i] < vids[j]:
+				i++
+			case sel[i] > vids[j]:
+				j++
+			default:
+				ret = append(ret, sel[i])
+				found[i] = true
+				i++
+				j++
+			}
+		}
+		if desc {
+			part := ret[start:]
+			for i, j := 0, len(part)-1; i < j; i, j = i+1, j-1 {
+				part[i], part[j] = part[j], part[i]
+			}
+		}
+		return len(ret) < k
+	}
+	if desc {
+		if v, ok := c.MaxVal(); ok {
+			c.IterateVDown(v, f)
+		}
+	} else {
+		if v, ok := c.MinVal(); ok {
+			c.IterateVUp(v, f)
+		}
+	}
+
+	// пустые значения в конце
+	for i := range sel {
+		if len(ret) >= k {
+			break
+		}
+		j := i
+		if desc {
+			j = len(sel) - 1 - i
+		}
+		if !found[j] {
+			ret = append(ret, sel[j])
+		}
+	}
+	if len(ret) > k {
+		ret = ret[:k]
+	}
+	*ids = ret
+	return true
+}
+
+// sortOrder sorts sel by ranks of values, keeping only first k IDs on the heap
+func (c *Column) sortOrder(sel []IDEntry, desc bool, k int) []IDEntry {
+	c.RLock()
+	data := c.view()
+	maxId := c.maxId
+	c.RUnlock()
+	ranks := c.dict.Ranks()
+
+	// пустые значения в конце
+	var last int32 = math.MaxInt32
+	if desc {
+		last = -1
+	}
+	key := func(id IDEntry) orderKey {
+		if id > maxId {
+			return orderKey{rank: last, id: id}
+		}
+		v := data.Get(id)
+		if v == NullEntry || v == data.empty || int(v) >= len(ranks) {
+			return orderKey{rank: last, id: id}
+		}
+		return orderKey{rank: ranks[v], id: id}
+	}
+
+	var keys []orderKey
+	if k < len(sel) {
+		h := &orderHeap{
+			desc:  desc,
+			Elems: make([]orderKey, 0, k),
+		}
+		for _, id := range sel {
+			x := key(id)
+			if h.Len() < k {
+				pushOrderHeap(h, x)
+			} else if x.less(h.Elems[0], desc) {
+				h.Elems[0] = x
+				downOrderHeap(h, 0, h.Len())
+			}
+		}
+		keys = h.Elems
+	} else {
+		keys = make([]orderKey, len(sel))
+		for i, id := range sel {
+			keys[i] = key(id)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j], desc) })
+
+	ret := make([]IDEntry, len(keys))
+	for i, x := range keys {
+		ret[i] = x.id
+	}
+	return ret
+}
@@ -0,0 +1,766 @@
+package db
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// Сжатый список ID в стиле roaring bitmap: старшие 16 бит ID - ключ контейнера,
+// младшие 16 бит хранятся в контейнере одним из трех способов, какой короче.
+
+const (
+	contArray  uint8 = iota // сортированные значения
+	contBitmap              // биткарта на 1<<16 значений
+	contRun                 // пары начало, конец (включительно) отрезков
+)
+
+const (
+	arrayMax    = 4096 // больше значений в массиве занимают больше биткарты
+	bitmapWords = 1 << 10
+	bitmapBytes = bitmapWords * 8
+
+	// списки ID короче хранятся слайсом, длиннее - в контейнерах, если так меньше памяти
+	roaringMinIDs = 64
+	// контейнер занимает в roaring.conts
+	containerBytes = 64
+)
+
+type container struct {
+	kind  uint8
+	epoch uint64 // эпоха колонки, в которой данные контейнера созданы или скопированы
+	n     int32
+	vals  []uint16 // contArray, contRun
+	words []uint64 // contBitmap
+}
+
+// roaring can be changed in place only in the epoch of its creation,
+// iterators get it with the increment of the column epoch
+type roaring struct {
+	epoch uint64
+	n     int
+	keys  []uint16
+	conts []container
+}
+
+// newRoaring makes the compressed list from ascending IDs
+func newRoaring(ids []IDEntry, epoch uint64) *roaring {
+	bm := &roaring{epoch: epoch, n: len(ids)}
+	lows := make([]uint16, 0, arrayMax)
+	for i := 0; i < len(ids); {
+		key := uint16(uint32(ids[i]) >> 16)
+		lows = lows[:0]
+		for ; i < len(ids) && uint16(uint32(ids[i])>>16) == key; i++ {
+			lows = append(lows, uint16(ids[i]))
+		}
+		bm.keys = append(bm.keys, key)
+		bm.conts = append(bm.conts, containerOf(lows, epoch))
+	}
+	return bm
+}
+
+// size returns the memory used by the list in bytes
+func (bm *roaring) size() int {
+	n := 2 * len(bm.keys)
+	for i := range bm.conts {
+		n += containerBytes + 2*len(bm.conts[i].vals) + 8*len(bm.conts[i].words)
+	}
+	return n
+}
+
+func (bm *roaring) appendIDs(dst []IDEntry) []IDEntry {
+	var lows []uint16
+	for i := range bm.conts {
+		hi := uint32(bm.keys[i]) << 16
+		lows = bm.conts[i].appendLows(lows[:0])
+		for _, l := range lows {
+			dst = append(dst, IDEntry(hi|uint32(l)))
+		}
+	}
+	return dst
+}
+
+func (bm *roaring) find(key uint16) (int, bool) {
+	i := sort.Search(len(bm.keys), func(i int) bool { return bm.keys[i] >= key })
+	return i, i < len(bm.keys) && bm.keys[i] == key
+}
+
+// contains reports whether id is in the list
+func (bm *roaring) contains(id IDEntry) bool {
+	i, ok := bm.find(uint16(uint32(id) >> 16))
+	return ok && bm.conts[i].contains(uint16(id))
+}
+
+// own returns the list, which can be changed in the epoch
+func (bm *roaring) own(epoch uint64) *roaring {
+	if bm.epoch == epoch {
+		return bm
+	}
+	return &roaring{
+		epoch: epoch,
+		n:     bm.n,
+		keys:  append(make([]uint16, 0, cap(bm.keys)), bm.keys...),
+		conts: append(make([]container, 0, cap(bm.conts)), bm.conts...),
+	}
+}
+
+// add inserts id into the list owned in the epoch
+func (bm *roaring) add(id IDEntry, epoch uint64) bool {
+	key, low := uint16(uint32(id)>>16), uint16(id)
+	i, ok := bm.find(key)
+	if !ok {
+		bm.keys = append(bm.keys, 0)
+		copy(bm.keys[i+1:], bm.keys[i:])
+		bm.keys[i] = key
+		bm.conts = append(bm.conts, container{})
+		copy(bm.conts[i+1:], bm.conts[i:])
+		bm.conts[i] = container{kind: contArray, epoch: epoch}
+	}
+	c := &bm.conts[i]
+	c.own(epoch)
+	if !c.add(low) {
+		return false
+	}
+	bm.n++
+	return true
+}
+
+// remove deletes id from the list owned in the epoch
+func (bm *roaring) remove(id IDEntry, epoch uint64) bool {
+	i, ok := bm.find(uint16(uint32(id) >> 16))
+	if !ok || !bm.conts[i].contains(uint16(id)) {
+		return false
+	}
+	c := &bm.conts[i]
+	c.own(epoch)
+	c.remove(uint16(id))
+	bm.n--
+	if c.n == 0 {
+		bm.keys = append(bm.keys[:i], bm.keys[i+1:]...)
+		bm.conts = append(bm.conts[:i], bm.conts[i+1:]...)
+	}
+	return true
+}
+
+// own copies the data of the container, if it may be read by iterators
+func (c *container) own(epoch uint64) {
+	if c.epoch == epoch {
+		return
+	}
+	c.epoch = epoch
+	if c.vals != nil {
+		c.vals = append(make([]uint16, 0, cap(c.vals)), c.vals...)
+	}
+	if c.words != nil {
+		c.words = append(make([]uint64, 0, bitmapWords), c.words...)
+	}
+}
+
+// containerOf makes the shortest container of ascending values
+func containerOf(lows []uint16, epoch uint64) container {
+	c := container{epoch: epoch, n: int32(len(lows))}
+	runs := 0
+	for i, l := range lows {
+		if i == 0 || lows[i-1]+1 != l {
+			runs++
+		}
+	}
+	switch {
+	case 4*runs < 2*len(lows) && 4*runs < bitmapBytes:
+		c.kind = contRun
+		c.vals = make([]uint16, 0, 2*runs)
+		for i, l := range lows {
+			if i == 0 || lows[i-1]+1 != l {
+				c.vals = append(c.vals, l, l)
+			} else {
+				c.vals[len(c.vals)-1] = l
+			}
+		}
+	case len(lows) <= arrayMax:
+		c.kind = contArray
+		c.vals = append(make([]uint16, 0, len(lows)), lows...)
+	default:
+		c.kind = contBitmap
+		c.words = make([]uint64, bitmapWords)
+		for _, l := range lows {
+			c.words[l>>6] |= 1 << (l & 0x3f)
+		}
+	}
+	return c
+}
+
+// optimize changes the kind of the container to the shortest one
+func (c *container) optimize() {
+	*c = containerOf(c.appendLows(make([]uint16, 0, c.n)), c.epoch)
+}
+
+func (c *container) appendLows(dst []uint16) []uint16 {
+	switch c.kind {
+	case contArray:
+		return append(dst, c.vals...)
+	case contRun:
+		for i := 0; i < len(c.vals); i += 2 {
+			for l := uint32(c.vals[i]); l <= uint32(c.vals[i+1]); l++ {
+				dst = append(dst, uint16(l))
+			}
+		}
+		return dst
+	}
+	for i, w := range c.words {
+		for w != 0 {
+			dst = append(dst, uint16(i<<6+bits.TrailingZeros64(w)))
+			w &= w - 1
+		}
+	}
+	return dst
+}
+
+// runIndex returns the first run, which ends not before x
+func (c *container) runIndex(x uint16) int {
+	return sort.Search(len(c.vals)/2, func(i int) bool { return c.vals[2*i+1] >= x })
+}
+
+func (c *container) contains(x uint16) bool {
+	switch c.kind {
+	case contArray:
+		i := sort.Search(len(c.vals), func(i int) bool { return c.vals[i] >= x })
+		return i < len(c.vals) && c.vals[i] == x
+	case contRun:
+		i := c.runIndex(x)
+		return 2*i < len(c.vals) && c.vals[2*i] <= x
+	}
+	return c.words[x>>6]&(1<<(x&0x3f)) != 0
+}
+
+// add inserts x into the owned container
+func (c *container) add(x uint16) bool {
+	switch c.kind {
+	case contArray:
+		i := sort.Search(len(c.vals), func(i int) bool { return c.vals[i] >= x })
+		if i < len(c.vals) && c.vals[i] == x {
+			return false
+		}
+		if len(c.vals) == arrayMax {
+			c.toBitmap()
+			return c.add(x)
+		}
+		c.vals = append(c.vals, 0)
+		copy(c.vals[i+1:], c.vals[i:])
+		c.vals[i] = x
+	case contRun:
+		i := c.runIndex(x)
+		r := len(c.vals) / 2
+		if i < r && c.vals[2*i] <= x {
+			return false
+		}
+		left := i > 0 && uint32(c.vals[2*i-1])+1 == uint32(x)
+		right := i < r && uint32(x)+1 == uint32(c.vals[2*i])
+		switch {
+		case left && right:
+			// отрезки сливаются
+			c.vals[2*i-1] = c.vals[2*i+1]
+			c.vals = append(c.vals[:2*i], c.vals[2*i+2:]...)
+		case left:
+			c.vals[2*i-1] = x
+		case right:
+			c.vals[2*i] = x
+		default:
+			c.vals = append(c.vals, 0, 0)
+			copy(c.vals[2*i+2:], c.vals[2*i:])
+			c.vals[2*i], c.vals[2*i+1] = x, x
+			if 2*len(c.vals) > bitmapBytes {
+				c.n++
+				c.toBitmap()
+				return true
+			}
+		}
+	default:
+		w := &c.words[x>>6]
+		if *w&(1<<(x&0x3f)) != 0 {
+			return false
+		}
+		*w |= 1 << (x & 0x3f)
+	}
+	c.n++
+	if c.n&(c.n-1) == 0 && c.n >= roaringMinIDs {
+		c.optimize()
+	}
+	return true
+}
+
+// remove deletes x contained in the owned container
+func (c *container) remove(x uint16) {
+	switch c.kind {
+	case contArray:
+		i := sort.Search(len(c.vals), func(i int) bool { return c.vals[i] >= x })
+		c.vals = append(c.vals[:i], c.vals[i+1:]...)
+	case contRun:
+		i := c.runIndex(x)
+		start, last := c.vals[2*i], c.vals[2*i+1]
+		switch {
+		case start == last:
+			c.vals = append(c.vals[:2*i], c.vals[2*i+2:]...)
+		case start == x:
+			c.vals[2*i]++
+		case last == x:
+			c.vals[2*i+1]--
+		default:
+			// отрезок разбивается на два
+			c.vals = append(c.vals, 0, 0)
+			copy(c.vals[2*i+2:], c.vals[2*i:])
+			c.vals[2*i+1] = x - 1
+			c.vals[2*i+2] = x + 1
+		}
+	default:
+		c.words[x>>6] &^= 1 << (x & 0x3f)
+	}
+	c.n--
+	if c.n > 0 && (c.n&(c.n-1) == 0 || c.kind == contRun && 2*len(c.vals) > bitmapBytes) {
+		c.optimize()
+	}
+}
+
+func (c *container) toBitmap() {
+	words := make([]uint64, bitmapWords)
+	for _, l := range c.appendLows(make([]uint16, 0, c.n)) {
+		words[l>>6] |= 1 << (l & 0x3f)
+	}
+	c.kind, c.vals, c.words = contBitmap, nil, words
+}
+
+// seek returns the least value not less than x and its position in the container,
+// hint is the position of the previous value or -1
+func (c *container) seek(x uint16, hint int) (uint16, int, bool) {
+	switch c.kind {
+	case contArray:
+		i := hint + 1
+		if !(i > 0 && i < len(c.vals) && c.vals[i-1] < x && c.vals[i] >= x) {
+			i = sort.Search(len(c.vals), func(i int) bool { return c.vals[i] >= x })
+		}
+		if i < len(c.vals) {
+			return c.vals[i], i, true
+		}
+	case contRun:
+		// следующее значение в том же или следующем отрезке
+		i := hint
+		if !c.inRun(i, x) {
+			if i++; !c.inRun(i, x) {
+				i = c.runIndex(x)
+			}
+		}
+		if 2*i < len(c.vals) {
+			if c.vals[2*i] > x {
+				x = c.vals[2*i]
+			}
+			return x, i, true
+		}
+	default:
+		wi := int(x >> 6)
+		w := c.words[wi] >> (x & 0x3f) << (x & 0x3f)
+		for {
+			if w != 0 {
+				return uint16(wi<<6 + bits.TrailingZeros64(w)), 0, true
+			}
+			if wi++; wi == bitmapWords {
+				break
+			}
+			w = c.words[wi]
+		}
+	}
+	return 0, 0, false
+}
+
+// seekBack returns the greatest value not greater than x and its position in the container
+func (c *container) seekBack(x uint16, hint int) (uint16, int, bool) {
+	switch c.kind {
+	case contArray:
+		i := hint - 1
+		if !(i >= 0 && i+1 < len(c.vals) && c.vals[i] <= x && c.vals[i+1] > x) {
+			i = sort.Search(len(c.vals), func(i int) bool { return c.vals[i] > x }) - 1
+		}
+		if i >= 0 {
+			return c.vals[i], i, true
+		}
+	case contRun:
+		i := sort.Search(len(c.vals)/2, func(i int) bool { return c.vals[2*i] > x }) - 1
+		if i >= 0 {
+			if c.vals[2*i+1] < x {
+				x = c.vals[2*i+1]
+			}
+			return x, i, true
+		}
+	default:
+		wi := int(x >> 6)
+		sh := 63 - x&0x3f
+		w := c.words[wi] << sh >> sh
+		for {
+			if w != 0 {
+				return uint16(wi<<6 + 63 - bits.LeadingZeros64(w)), 0, true
+			}
+			if wi--; wi < 0 {
+				break
+			}
+			w = c.words[wi]
+		}
+	}
+	return 0, 0, false
+}
+
+// inRun reports whether i is the first run, which ends not before x
+func (c *container) inRun(i int, x uint16) bool {
+	return i >= 0 && 2*i+1 < len(c.vals) && c.vals[2*i+1] >= x && (i == 0 || c.vals[2*i-1] < x)
+}
+
+// rank returns the number of values not greater than x
+func (c *container) rank(x uint16) int {
+	switch c.kind {
+	case contArray:
+		return sort.Search(len(c.vals), func(i int) bool { return c.vals[i] > x })
+	case contRun:
+		n := 0
+		for i := 0; i < len(c.vals) && c.vals[i] <= x; i += 2 {
+			last := c.vals[i+1]
+			if last > x {
+				last = x
+			}
+			n += int(last-c.vals[i]) + 1
+		}
+		return n
+	}
+	n := 0
+	wi := int(x >> 6)
+	for _, w := range c.words[:wi] {
+		n += bits.OnesCount64(w)
+	}
+	sh := 63 - x&0x3f
+	return n + bits.OnesCount64(c.words[wi]<<sh)
+}
+
+// bitmap returns the words of the container, the bitmap container is not copied
+func (c *container) bitmap() []uint64 {
+	if c.kind == contBitmap {
+		return c.words
+	}
+	words := make([]uint64, bitmapWords)
+	if c.kind == contRun {
+		for i := 0; i < len(c.vals); i += 2 {
+			setRange(words, uint32(c.vals[i]), uint32(c.vals[i+1]))
+		}
+		return words
+	}
+	for _, l := range c.vals {
+		words[l>>6] |= 1 << (l & 0x3f)
+	}
+	return words
+}
+
+// setRange sets bits from lo to hi inclusive
+func setRange(words []uint64, lo, hi uint32) {
+	for lo <= hi {
+		w, b := lo>>6, lo&0x3f
+		e := uint32(63)
+		if w == hi>>6 {
+			e = hi & 0x3f
+		}
+		words[w] |= (^uint64(0) >> (63 - e + b)) << b
+		lo = w<<6 + e + 1
+	}
+}
+
+func containerOfWords(words []uint64) container {
+	n := 0
+	for _, w := range words {
+		n += bits.OnesCount64(w)
+	}
+	c := container{kind: contBitmap, n: int32(n), words: words}
+	c.optimize()
+	return c
+}
+
+func andContainers(a, b *container) container {
+	if a.kind == contBitmap && b.kind == contBitmap {
+		words := make([]uint64, bitmapWords)
+		for i := range words {
+			words[i] = a.words[i] & b.words[i]
+		}
+		return containerOfWords(words)
+	}
+	if a.n > b.n {
+		a, b = b, a
+	}
+	var lows []uint16
+	for _, l := range a.appendLows(make([]uint16, 0, a.n)) {
+		if b.contains(l) {
+			lows = append(lows, l)
+		}
+	}
+	return containerOf(lows, 0)
+}
+
+func orContainers(a, b *container) container {
+	if a.kind != contBitmap && b.kind != contBitmap && a.n+b.n <= arrayMax {
+		la, lb := a.appendLows(make([]uint16, 0, a.n)), b.appendLows(make([]uint16, 0, b.n))
+		lows := make([]uint16, 0, len(la)+len(lb))
+		i, j := 0, 0
+		for i < len(la) || j < len(lb) {
+			switch {
+			case j == len(lb) || i < len(la) && la[i] < lb[j]:
+				lows = append(lows, la[i])
+				i++
+			case i == len(la) || lb[j] < la[i]:
+				lows = append(lows, lb[j])
+				j++
+			default:
+				lows = append(lows, la[i])
+				i++
+				j++
+			}
+		}
+		return containerOf(lows, 0)
+	}
+	words := append(make([]uint64, 0, bitmapWords), a.bitmap()...)
+	for i, w := range b.bitmap() {
+		words[i] |= w
+	}
+	return containerOfWords(words)
+}
+
+// andRoaring intersects lists by containers with equal keys
+func andRoaring(a, b *roaring) *roaring {
+	ret := &roaring{}
+	for i, j := 0, 0; i < len(a.keys) && j < len(b.keys); {
+		switch {
+		case a.keys[i] < b.keys[j]:
+			i++
+		case a.keys[i] > b.keys[j]:
+			j++
+		default:
+			if c := andContainers(&a.conts[i], &b.conts[j]); c.n > 0 {
+				ret.keys = append(ret.keys, a.keys[i])
+				ret.conts = append(ret.conts, c)
+				ret.n += int(c.n)
+			}
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+// orRoaring merges lists by containers with equal keys, other containers are shared
+func orRoaring(a, b *roaring) *roaring {
+	ret := &roaring{}
+	add := func(key uint16, c container) {
+		ret.keys = append(ret.keys, key)
+		ret.conts = append(ret.conts, c)
+		ret.n += int(c.n)
+	}
+	i, j := 0, 0
+	for i < len(a.keys) || j < len(b.keys) {
+		switch {
+		case j == len(b.keys) || i < len(a.keys) && a.keys[i] < b.keys[j]:
+			add(a.keys[i], a.conts[i])
+			i++
+		case i == len(a.keys) || b.keys[j] < a.keys[i]:
+			add(b.keys[j], b.conts[j])
+			j++
+		default:
+			add(a.keys[i], orContainers(&a.conts[i], &b.conts[j]))
+			i++
+			j++
+		}
+	}
+	return ret
+}
+
+// RoaringIterator returns IDs of the compressed posting list of a value
+type RoaringIterator struct {
+	bm         *roaring
+	col        *Column
+	reversed   bool
+	started    bool
+	done       bool
+	ci         int // текущий контейнер
+	hint       int // позиция текущего ID в контейнере
+	currid     IDEntry
+	min, max   IDEntry
+	lastJumpTo IDEntry
+	lastJumpOk bool
+}
+
+func newRoaringIterator(c *Column, bm *roaring, reversed bool) *RoaringIterator {
+	ret := &RoaringIterator{bm: bm, col: c, reversed: reversed, done: bm.n == 0, hint: -1}
+	if bm.n > 0 {
+		last := len(bm.keys) - 1
+		lo, _, _ := bm.conts[0].seek(0, -1)
+		hi, _, _ := bm.conts[last].seekBack(0xffff, -1)
+		ret.min = IDEntry(uint32(bm.keys[0])<<16 | uint32(lo))
+		ret.max = IDEntry(uint32(bm.keys[last])<<16 | uint32(hi))
+	}
+	return ret
+}
+
+func (iter *RoaringIterator) Clone() IDIterator {
+	rv := &RoaringIterator{}
+	*rv = *iter
+	return rv
+}
+
+func (iter *RoaringIterator) Cardinality() int32 {
+	return int32(iter.bm.n)
+}
+
+func (iter *RoaringIterator) EstimatedCardinality() int {
+	return iter.bm.n
+}
+
+// ExactCount counts values of containers after the current position
+func (iter *RoaringIterator) ExactCount() int {
+	switch {
+	case !iter.started:
+		return iter.bm.n
+	case iter.done:
+		return 0
+	}
+	c := &iter.bm.conts[iter.ci]
+	r := c.rank(uint16(iter.currid))
+	if iter.reversed {
+		n := r - 1
+		for i := range iter.bm.conts[:iter.ci] {
+			n += int(iter.bm.conts[i].n)
+		}
+		return n
+	}
+	n := int(c.n) - r
+	for i := range iter.bm.conts[iter.ci+1:] {
+		n += int(iter.bm.conts[iter.ci+1+i].n)
+	}
+	return n
+}
+
+func (iter *RoaringIterator) Reversed() bool {
+	return iter.reversed
+}
+
+func (iter *RoaringIterator) Range() (IDEntry, IDEntry) {
+	return iter.min, iter.max
+}
+
+// seek moves to the least ID not less than id, or the greatest one not greater than id for the reversed iterator
+func (iter *RoaringIterator) seek(id IDEntry) bool {
+	iter.started = true
+	bm := iter.bm
+	key, low := uint16(uint32(id)>>16), uint16(id)
+	i := iter.ci
+	if i < 0 || i >= len(bm.keys) || bm.keys[i] != key {
+		i, _ = bm.find(key)
+	}
+	if iter.reversed {
+		if i == len(bm.keys) || bm.keys[i] != key {
+			i--
+			low = 0xffff
+		}
+		for ; i >= 0; i-- {
+			hint := -1
+			if i == iter.ci {
+				hint = iter.hint
+			}
+			if l, h, ok := bm.conts[i].seekBack(low, hint); ok {
+				iter.ci, iter.hint = i, h
+				iter.currid = IDEntry(uint32(bm.keys[i])<<16 | uint32(l))
+				return true
+			}
+			low = 0xffff
+		}
+	} else {
+		for ; i < len(bm.keys); i++ {
+			hint := -1
+			if i == iter.ci {
+				hint = iter.hint
+			}
+			if bm.keys[i] != key {
+				low = 0
+			}
+			if l, h, ok := bm.conts[i].seek(low, hint); ok {
+				iter.ci, iter.hint = i, h
+				iter.currid = IDEntry(uint32(bm.keys[i])<<16 | uint32(l))
+				return true
+			}
+		}
+	}
+	iter.done = true
+	return false
+}
+
+func (iter *RoaringIterator) HasNext() bool {
+	if iter.done {
+		return false
+	}
+	switch {
+	case !iter.started && iter.reversed:
+		return iter.seek(0xffffffff)
+	case !iter.started:
+		return iter.seek(0)
+	case iter.reversed && iter.currid > 0:
+		return iter.seek(iter.currid - 1)
+	case !iter.reversed && iter.currid < 0xffffffff:
+		return iter.seek(iter.currid + 1)
+	}
+	iter.done = true
+	return false
+}
+
+func (iter *RoaringIterator) NextID() IDEntry {
+	if iter.started && !iter.done {
+		return iter.currid
+	}
+	return 0
+}
+
+func (iter *RoaringIterator) JumpTo(id IDEntry) bool {
+	if iter.bm.n == 0 {
+		return false
+	}
+	if iter.lastJumpTo == id {
+		return iter.lastJumpOk
+	}
+	iter.lastJumpTo = id
+	iter.done = false
+	iter.lastJumpOk = iter.seek(id)
+	return iter.lastJumpOk
+}
+
+// combineRoaring replaces not started iterators of compressed lists by one iterator,
+// which is made by container-wise intersection (and) or union of their lists
+func combineRoaring(iters []IDIterator, and bool) []IDIterator {
+	if len(iters) < 2 {
+		return iters
+	}
+	reversed := iters[0].Reversed()
+	var bm *roaring
+	var col *Column
+	ret := make([]IDIterator, 0, len(iters))
+	n := 0
+	for _, it := range iters {
+		ri, ok := it.(*RoaringIterator)
+		if !ok || ri.started || ri.reversed != reversed {
+			ret = append(ret, it)
+			continue
+		}
+		n++
+		switch {
+		case bm == nil:
+			bm, col = ri.bm, ri.col
+		case and:
+			bm = andRoaring(bm, ri.bm)
+		default:
+			bm = orRoaring(bm, ri.bm)
+		}
+		if ri.col != col {
+			col = nil
+		}
+	}
+	if n < 2 {
+		return iters
+	}
+	return append(ret, newRoaringIterator(col, bm, reversed))
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"time"
+)
+
+// fetchBatch - количество строк, значения которых читаются из колонки за одну блокировку
+const fetchBatch = 256
+
+var (
+	ErrScanType  = errors.New("scan destination must be a pointer to struct")
+	ErrScanValue = errors.New("column value can't be stored to the struct field")
+)
+
+// RowIterator yields rows of values of the columns for IDs of the iterator, reading them by batches.
+// Values of ID without value in the column are nil.
+type RowIterator struct {
+	cols  []*Column
+	names []string
+	iter  IDIterator
+	err   error
+
+	ids  []IDEntry
+	vals []ColumnValue // значения строк пакета подряд
+	pos  int
+
+	// поля структуры по колонкам для Scan
+	scanType   reflect.Type
+	scanFields []int
+}
+
+// Fetch returns rows of the columns for IDs left in iter, all columns if cols are empty.
+// Unknown column is reported by Err.
+func (dt *DataTable) Fetch(iter IDIterator, cols ...string) *RowIterator {
+	ri := &RowIterator{
+		iter: iter,
+		pos:  -1,
+	}
+	if len(cols) == 0 {
+		for _, ct := range dt.metadata {
+			cols = append(cols, ct.Name)
+		}
+	}
+	for _, name := range cols {
+		col, err := dt.column(name)
+		if err != nil {
+			ri.err = err
+			return ri
+		}
+		ri.cols = append(ri.cols, col)
+		ri.names = append(ri.names, name)
+	}
+	return ri
+}
+
+// Columns returns names of the columns in the order of values
+func (ri *RowIterator) Columns() []string {
+	return ri.names
+}
+
+func (ri *RowIterator) Err() error {
+	return ri.err
+}
+
+// Next moves to the next row, false if there are no more rows
+func (ri *RowIterator) Next() bool {
+	if ri.err != nil || ri.iter == nil {
+		return false
+	}
+	ri.pos++
+	if ri.pos < len(ri.ids) {
+		return true
+	}
+	ri.fetch()
+	ri.pos = 0
+	return len(ri.ids) > 0
+}
+
+// fetch reads the next batch of IDs and their values column by column
+func (ri *RowIterator) fetch() {
+	ri.ids = ri.ids[:0]
+	for len(ri.ids) < fetchBatch && ri.iter.HasNext() {
+		ri.ids = append(ri.ids, ri.iter.NextID())
+	}
+	n := len(ri.cols)
+	if cap(ri.vals) < len(ri.ids)*n {
+		ri.vals = make([]ColumnValue, len(ri.ids)*n)
+	}
+	ri.vals = ri.vals[:len(ri.ids)*n]
+
+	des := make([]DataEntry, len(ri.ids))
+	for j, col := range ri.cols {
+		col.RLock()
+		for i, id := range ri.ids {
+			des[i] = NullEntry
+			if id >= col.minId && id <= col.maxId {
+				des[i] = col.Get(id)
+			}
+		}
+		col.RUnlock()
+		for i, de := range des {
+			var v ColumnValue
+			if de != NullEntry {
+				v = col.FromDictonary(de)
+			}
+			ri.vals[i*n+j] = v
+		}
+	}
+}
+
+// ID returns ID of the current row
+func (ri *RowIterator) ID() IDEntry {
+	return ri.ids[ri.pos]
+}
+
+// Values returns values of the current row, the slice is valid until the next call of Next
+func (ri *RowIterator) Values() []ColumnValue {
+	n := len(ri.cols)
+	return ri.vals[ri.pos*n : (ri.pos+1)*n]
+}
+
+// Scan stores values of the current row to fields of the struct by pointer dst.
+// Field is matched to column by the name in `cmemdb:"name"` tag or by the field name,
+// "-" skips the field. Value must be assignable to the field, or both must be integers, floats, strings or bools;
+// string values can be stored to []byte and values with Time() method to time.Time. Nil values set zero fields.
+func (ri *RowIterator) Scan(dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return ErrScanType
+	}
+	rv = rv.Elem()
+	if rv.Type() != ri.scanType {
+		ri.scanType = rv.Type()
+		ri.scanFields = scanFields(rv.Type(), ri.names)
+	}
+	for j, v := range ri.Values() {
+		fi := ri.scanFields[j]
+		if fi < 0 {
+			continue
+		}
+		if err := setField(rv.Field(fi), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanFields returns indexes of fields of the struct for the columns, -1 if there is no field
+func scanFields(t reflect.Type, names []string) []int {
+	byName := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, ok := tagColumn(t.Field(i)); ok {
+			byName[name] = i
+		}
+	}
+	ret := make([]int, len(names))
+	for j, name := range names {
+		fi, ok := byName[name]
+		if !ok {
+			fi = -1
+		}
+		ret[j] = fi
+	}
+	return ret
+}
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	bytesType = reflect.TypeOf([]byte(nil))
+)
+
+// kindClass returns the same number for kinds converted to each other by Scan, 0 for other kinds
+func kindClass(k reflect.Kind) int {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return 1
+	case reflect.Float32, reflect.Float64:
+		return 2
+	case reflect.String:
+		return 3
+	case reflect.Bool:
+		return 4
+	}
+	return 0
+}
+
+func setField(f reflect.Value, v ColumnValue) error {
+	if v == nil {
+		f.Set(reflect.Zero(f.Type()))
+		return nil
+	}
+	vv := reflect.ValueOf(v)
+	switch {
+	case vv.Type().AssignableTo(f.Type()):
+		f.Set(vv)
+	case kindClass(vv.Kind()) == 1 && kindClass(f.Kind()) == 1:
+		return setInt(f, vv)
+	case kindClass(vv.Kind()) == 2 && kindClass(f.Kind()) == 2:
+		if f.OverflowFloat(vv.Float()) {
+			return ErrScanValue
+		}
+		f.SetFloat(vv.Float())
+	case kindClass(vv.Kind()) != 0 && kindClass(vv.Kind()) == kindClass(f.Kind()):
+		f.Set(vv.Convert(f.Type()))
+	case vv.Kind() == reflect.String && f.Type() == bytesType:
+		f.SetBytes([]byte(vv.String()))
+	case f.Type() == timeType:
+		tv, ok := v.(interface{ Time() time.Time })
+		if !ok {
+			return ErrScanValue
+		}
+		f.Set(reflect.ValueOf(tv.Time()))
+	default:
+		return ErrScanValue
+	}
+	return nil
+}
+
+// setInt sets the integer field without truncation: values out of the field range return ErrScanValue,
+// unsigned values above math.MaxInt64 for signed fields return ErrUintRange
+func setInt(f, vv reflect.Value) error {
+	signed := func(k reflect.Kind) bool { return k >= reflect.Int && k <= reflect.Int64 }
+	switch {
+	case signed(vv.Kind()) && signed(f.Kind()):
+		if f.OverflowInt(vv.Int()) {
+			return ErrScanValue
+		}
+		f.SetInt(vv.Int())
+	case signed(vv.Kind()):
+		if vv.Int() < 0 || f.OverflowUint(uint64(vv.Int())) {
+			return ErrScanValue
+		}
+		f.SetUint(uint64(vv.Int()))
+	case signed(f.Kind()):
+		if vv.Uint() > math.MaxInt64 {
+			return ErrUintRange
+		}
+		if f.OverflowInt(int64(vv.Uint())) {
+			return ErrScanValue
+		}
+		f.SetInt(int64(vv.Uint()))
+	default:
+		if f.OverflowUint(vv.Uint()) {
+			return ErrScanValue
+		}
+		f.SetUint(vv.Uint())
+	}
+	return nil
+}
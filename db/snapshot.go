@@ -0,0 +1,607 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+)
+
+const (
+	snapshotMagic   = "CMEMDB"
+	snapshotVersion = 3 // 2: WAL sequence number, 3: value format and identities of shared dictonaries
+)
+
+// форматы значений, пишутся в заголовках снимка и журнала
+const (
+	valGob   byte = iota // длина uint32 и gob, снимки до версии 3 и журналы без заголовка
+	valCodec             // длина uvarint и AppendValue
+)
+
+var (
+	ErrSnapshotFormat  = errors.New("invalid snapshot format")
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+)
+
+const (
+	encVal byte = iota
+	enc1b
+	enc2b
+	enc4b
+	enc8b
+)
+
+type snapWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (sw *snapWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	n, err := sw.w.Write(p)
+	sw.n += int64(n)
+	sw.err = err
+	return n, err
+}
+
+func (sw *snapWriter) u8(v byte) {
+	sw.buf[0] = v
+	sw.Write(sw.buf[:1])
+}
+
+func (sw *snapWriter) u32(v uint32) {
+	binary.LittleEndian.PutUint32(sw.buf[:4], v)
+	sw.Write(sw.buf[:4])
+}
+
+func (sw *snapWriter) u64(v uint64) {
+	binary.LittleEndian.PutUint64(sw.buf[:8], v)
+	sw.Write(sw.buf[:8])
+}
+
+func (sw *snapWriter) str(s string) {
+	sw.u32(uint32(len(s)))
+	sw.Write([]byte(s))
+}
+
+// slice writes length and elements of slice of fixed size values
+func (sw *snapWriter) slice(ln int, data interface{}) {
+	sw.u32(uint32(ln))
+	if sw.err == nil && ln > 0 {
+		sw.err = binary.Write(sw, binary.LittleEndian, data)
+	}
+}
+
+// chunks writes the bitmap like slice of all its words
+func (sw *snapWriter) chunks(b chunks) {
+	sw.u32(uint32(b.len()))
+	for _, ch := range b {
+		if sw.err == nil && len(ch.words) > 0 {
+			sw.err = binary.Write(sw, binary.LittleEndian, ch.words)
+		}
+	}
+}
+
+// value writes the value encoded by AppendValue with its length
+func (sw *snapWriter) value(v ColumnValue) {
+	if sw.err != nil {
+		return
+	}
+	if v == nil {
+		sw.u8(0)
+		return
+	}
+	sw.u8(1)
+	b, err := AppendValue(nil, v)
+	if err != nil {
+		sw.err = err
+		return
+	}
+	n := binary.PutUvarint(sw.buf[:], uint64(len(b)))
+	sw.Write(sw.buf[:n])
+	sw.Write(b)
+}
+
+type snapReader struct {
+	r      *bufio.Reader
+	err    error
+	buf    [8]byte
+	format byte  // формат значений
+	sized  bool  // размер входа известен, длины проверяются по left
+	left   int64 // осталось байт во входе
+}
+
+// readChunk - наибольшее число байт, выделяемое под данные до их чтения, если размер входа неизвестен
+const readChunk = 1 << 20
+
+func (sr *snapReader) full(p []byte) {
+	if sr.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(sr.r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		sr.err = err
+	}
+	sr.left -= int64(len(p))
+}
+
+// capacity returns the number of elements to allocate before reading n elements of size bytes:
+// all of them, if the input size is known, otherwise up to readChunk bytes, so a corrupted length
+// of the stream fails at the end of input before allocating memory for it
+func (sr *snapReader) capacity(n, size int) int {
+	if sr.sized || n <= readChunk/size {
+		return n
+	}
+	return readChunk / size
+}
+
+// ReadByte reads uvarints with counting of the rest of input
+func (sr *snapReader) ReadByte() (byte, error) {
+	b := sr.u8()
+	return b, sr.err
+}
+
+func (sr *snapReader) u8() byte {
+	sr.full(sr.buf[:1])
+	if sr.err != nil {
+		return 0
+	}
+	return sr.buf[0]
+}
+
+func (sr *snapReader) u32() uint32 {
+	sr.full(sr.buf[:4])
+	if sr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(sr.buf[:4])
+}
+
+func (sr *snapReader) u64() uint64 {
+	sr.full(sr.buf[:8])
+	if sr.err != nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(sr.buf[:8])
+}
+
+// length reads length of the following data, which can't be greater than max and than the rest of input
+// of known size, so corrupted lengths don't allocate more memory than the input takes
+func (sr *snapReader) length(max uint32) int {
+	ln := sr.u32()
+	if sr.err == nil && (ln > max || sr.sized && int64(ln) > sr.left) {
+		sr.err = ErrSnapshotFormat
+	}
+	if sr.err != nil {
+		return 0
+	}
+	return int(ln)
+}
+
+func (sr *snapReader) str() string {
+	b := make([]byte, sr.length(1<<20))
+	sr.full(b)
+	return string(b)
+}
+
+func (sr *snapReader) uint64s() []uint64 {
+	var ret []uint64
+	sr.slice(&ret, sr.length(1<<30))
+	return ret
+}
+
+func (sr *snapReader) data(v interface{}) {
+	if sr.err == nil {
+		sr.err = binary.Read(sr.r, binary.LittleEndian, v)
+		if sr.err == io.EOF {
+			sr.err = io.ErrUnexpectedEOF
+		}
+		sr.left -= int64(binary.Size(v))
+	}
+}
+
+// slice reads n elements to the new slice by pointer ptr like data, the slice grows while reading like capacity
+func (sr *snapReader) slice(ptr interface{}, n int) {
+	sv := reflect.ValueOf(ptr).Elem()
+	step := sr.capacity(n, int(sv.Type().Elem().Size()))
+	ret := reflect.MakeSlice(sv.Type(), 0, step)
+	for ret.Len() < n && sr.err == nil {
+		k := n - ret.Len()
+		if k > step {
+			k = step
+		}
+		ret = reflect.AppendSlice(ret, reflect.MakeSlice(sv.Type(), k, k))
+		sr.data(ret.Slice(ret.Len()-k, ret.Len()).Interface())
+	}
+	sv.Set(ret)
+}
+
+func (sr *snapReader) value() ColumnValue {
+	if sr.u8() == 0 || sr.err != nil {
+		return nil
+	}
+	if sr.format == valGob {
+		var b []byte
+		sr.slice(&b, sr.length(1<<30))
+		if sr.err != nil {
+			return nil
+		}
+		var v ColumnValue
+		if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v); err != nil {
+			sr.err = err
+			return nil
+		}
+		return v
+	}
+	ln, err := binary.ReadUvarint(sr)
+	if err == nil && (ln > 1<<30 || sr.sized && int64(ln) > sr.left) {
+		err = ErrSnapshotFormat
+	}
+	if err != nil {
+		sr.err = err
+		return nil
+	}
+	var b []byte
+	sr.slice(&b, int(ln))
+	if sr.err != nil {
+		return nil
+	}
+	v, err := DecodeValue(b)
+	if err != nil {
+		sr.err = err
+		return nil
+	}
+	return v
+}
+
+// WriteTo writes snapshot of all columns and dictonaries in their native encodings, values are encoded by AppendValue.
+// Columns are read locked while writing, queued INSERT_ASYNC writes are not included, see Flush.
+func (dt *DataTable) WriteTo(w io.Writer) (int64, error) {
+	dt.rlockColumns()
+	defer dt.runlockColumns()
+
+	return dt.writeSnapshot(w)
+}
+
+func (dt *DataTable) rlockColumns() {
+	for _, col := range dt.columns {
+		col.RLock()
+	}
+}
+
+func (dt *DataTable) runlockColumns() {
+	for _, col := range dt.columns {
+		col.RUnlock()
+	}
+}
+
+// writeSnapshot must be called with read locked columns
+func (dt *DataTable) writeSnapshot(w io.Writer) (int64, error) {
+	sw := &snapWriter{w: bufio.NewWriter(w)}
+
+	// общие словари пишем один раз
+	var dicts []*Dictonary
+	dictidx := make(map[*Dictonary]int)
+	for _, col := range dt.columns {
+		if _, ok := dictidx[col.dict]; !ok {
+			dictidx[col.dict] = len(dicts)
+			dicts = append(dicts, col.dict)
+		}
+	}
+
+	sw.Write([]byte(snapshotMagic))
+	sw.u32(snapshotVersion)
+	sw.u8(valCodec)
+	dt.idmu.Lock()
+	sw.u32(uint32(dt.maxId))
+	dt.idmu.Unlock()
+	sw.u64(dt.lastSeq())
+
+	// общие словари пишем с идентичностью, чтобы восстановить их общими и для разных таблиц
+	ids := make([]uint64, len(dicts))
+	for i, col := range dt.columns {
+		if dt.metadata[i].Dictonary != nil {
+			ids[dictidx[col.dict]] = col.dict.id
+		}
+	}
+
+	sw.u32(uint32(len(dicts)))
+	for i, dct := range dicts {
+		sw.u64(ids[i])
+		dct.writeTo(sw)
+	}
+
+	sw.u32(uint32(len(dt.columns)))
+	for i, col := range dt.columns {
+		ct := dt.metadata[i]
+		sw.str(ct.Name)
+		sw.u32(uint32(ct.Lines))
+		sw.u32(uint32(ct.UniqueValues))
+		sw.u32(uint32(dictidx[col.dict]))
+		col.writeTo(sw)
+	}
+
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	return sw.n, sw.err
+}
+
+func (ld *Dictonary) writeTo(sw *snapWriter) {
+	ld.rlockSorted()
+	defer ld.RUnlock()
+
+	sw.u32(uint32(len(ld.ms)))
+	for _, v := range ld.ms {
+		sw.value(v)
+	}
+	sw.slice(len(ld.ord), ld.ord)
+}
+
+func (c *Column) writeTo(sw *snapWriter) {
+	switch {
+	case c.use1b:
+		sw.u8(enc1b)
+	case c.use2b:
+		sw.u8(enc2b)
+	case c.use4b:
+		sw.u8(enc4b)
+	case c.use8b:
+		sw.u8(enc8b)
+	default:
+		sw.u8(encVal)
+	}
+	sw.u32(uint32(c.empty))
+	sw.u32(uint32(c.minId))
+	sw.u32(uint32(c.maxId))
+
+	if !c.useval {
+		sw.chunks(c.bmp)
+		sw.slice(len(c.count), c.count)
+		sw.chunks(c.del)
+		return
+	}
+
+	sw.u32(c.bucketsCount)
+	sw.slice(len(c.cluster), c.cluster)
+	for _, bucket := range c.values {
+		sw.u32(uint32(len(bucket)))
+		for _, ve := range bucket {
+			sw.u32(ve.rem)
+			if ve.bm != nil {
+				ids := ve.bm.appendIDs(nil)
+				sw.slice(len(ids), ids)
+			} else {
+				sw.slice(len(ve.ids), ve.ids)
+			}
+		}
+	}
+}
+
+// inputSize returns the size of the rest of input, false if it is unknown, e.g. for pipes and streams
+func inputSize(r io.Reader) (int64, bool) {
+	switch rr := r.(type) {
+	case interface{ Len() int }:
+		return int64(rr.Len()), true
+	case *os.File:
+		if fi, err := rr.Stat(); err == nil && fi.Mode().IsRegular() {
+			if pos, err := rr.Seek(0, io.SeekCurrent); err == nil {
+				return fi.Size() - pos, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// ReadDataTable reads snapshot written by WriteTo
+func ReadDataTable(r io.Reader) (*DataTable, error) {
+	return ReadDataTableShared(r, nil)
+}
+
+// ReadDataTableShared reads snapshot written by WriteTo, dictonaries shared with tables
+// read before with the same map are shared again, e.g. for merge joins.
+// New shared dictonaries are added to the map.
+func ReadDataTableShared(r io.Reader, shared map[uint64]*Dictonary) (*DataTable, error) {
+	sr := &snapReader{r: bufio.NewReader(r)}
+	sr.left, sr.sized = inputSize(r)
+
+	magic := make([]byte, len(snapshotMagic))
+	sr.full(magic)
+	if sr.err != nil {
+		return nil, sr.err
+	}
+	if string(magic) != snapshotMagic {
+		return nil, ErrSnapshotFormat
+	}
+	version := sr.u32()
+	if (version < 1 || version > snapshotVersion) && sr.err == nil {
+		return nil, ErrSnapshotVersion
+	}
+	if version >= 3 {
+		sr.format = sr.u8()
+		if sr.format > valCodec && sr.err == nil {
+			return nil, ErrSnapshotFormat
+		}
+	}
+
+	dt := &DataTable{
+		names: make(map[string]int),
+		maxId: IDEntry(sr.u32()),
+	}
+	if version >= 2 {
+		dt.walSeq = sr.u64()
+	}
+
+	ndicts := sr.length(1 << 20)
+	dicts := make([]*Dictonary, 0, sr.capacity(ndicts, 8))
+	loaded := make([]*Dictonary, 0, cap(dicts))
+	remaps := make([][]DictIndex, 0, cap(dicts))
+	ids := make([]uint64, 0, cap(dicts))
+	for i := 0; i < ndicts && sr.err == nil; i++ {
+		var id uint64
+		if version >= 3 {
+			id = sr.u64()
+		}
+		ids = append(ids, id)
+		loaded = append(loaded, readDictonary(sr))
+		dicts = append(dicts, loaded[i])
+		remaps = append(remaps, nil)
+		if ids[i] == 0 || sr.err != nil {
+			continue
+		}
+		dicts[i].id = ids[i]
+		if dct, ok := shared[ids[i]]; ok {
+			// колонки читаются со словарем снимка и перекодируются, если индексы значений разошлись
+			remaps[i] = dct.merge(loaded[i])
+			dicts[i] = dct
+		} else if shared != nil {
+			shared[ids[i]] = dicts[i]
+		}
+	}
+
+	ncols := sr.length(1 << 20)
+	coldict := make([]int, 0, sr.capacity(ncols, 8))
+	dictuse := make([]int, len(dicts))
+	for i := 0; i < ncols && sr.err == nil; i++ {
+		ct := &ColumnType{
+			Name:         sr.str(),
+			Index:        i,
+			Lines:        int(sr.u32()),
+			UniqueValues: int(sr.u32()),
+		}
+		di := sr.length(uint32(len(dicts)))
+		if sr.err == nil && di >= len(dicts) {
+			sr.err = ErrSnapshotFormat
+		}
+		if sr.err != nil {
+			break
+		}
+		dictuse[di]++
+		coldict = append(coldict, di)
+		col := readColumn(sr, loaded[di])
+		if sr.err != nil {
+			break
+		}
+		if remaps[di] != nil {
+			if col, sr.err = col.remap(dicts[di], remaps[di], ct.Lines, ct.UniqueValues); sr.err != nil {
+				break
+			}
+		} else {
+			col.dict = dicts[di]
+		}
+		ct.ZeroValue = col.dict.Get(DictIndex(col.empty))
+		ct.Dictonary = dicts[di]
+		dt.names[ct.Name] = i
+		dt.metadata = append(dt.metadata, ct)
+		dt.columns = append(dt.columns, col)
+	}
+	if sr.err != nil {
+		return nil, sr.err
+	}
+	// собственные словари колонок не считаются общими
+	for i, ct := range dt.metadata {
+		if version >= 3 && ids[coldict[i]] == 0 || version < 3 && dictuse[coldict[i]] < 2 {
+			ct.Dictonary = nil
+		}
+	}
+	return dt, nil
+}
+
+func readDictonary(sr *snapReader) *Dictonary {
+	n := sr.length(1 << 31)
+	c := sr.capacity(n, 16)
+	if c > 1<<20 {
+		c = 1 << 20
+	}
+	ld := NewDictonary(c)
+	for i := 0; i < n && sr.err == nil; i++ {
+		v := sr.value()
+		ld.ms = append(ld.ms, v)
+		if v != nil {
+			ld.mm[v] = DictIndex(i)
+		}
+	}
+	sr.slice(&ld.ord, sr.length(uint32(n)))
+	ld.rank = make([]int32, len(ld.ms), cap(ld.ms))
+	for i := range ld.rank {
+		ld.rank[i] = -1
+	}
+	for i, idx := range ld.ord {
+		if int(idx) >= len(ld.ms) {
+			sr.err = ErrSnapshotFormat
+			break
+		}
+		ld.rank[idx] = int32(i)
+	}
+	return ld
+}
+
+func readColumn(sr *snapReader, dct *Dictonary) *Column {
+	c := &Column{
+		dict: dct,
+	}
+	switch sr.u8() {
+	case enc1b:
+		c.use1b = true
+	case enc2b:
+		c.use2b = true
+	case enc4b:
+		c.use4b = true
+	case enc8b:
+		c.use8b = true
+	case encVal:
+		c.useval = true
+	default:
+		if sr.err == nil {
+			sr.err = ErrSnapshotFormat
+		}
+	}
+	c.empty = DataEntry(sr.u32())
+	c.minId = IDEntry(sr.u32())
+	c.maxId = IDEntry(sr.u32())
+
+	if !c.useval {
+		c.bmp = chunksOf(sr.uint64s(), 0)
+		c.count = make([]int32, sr.length(256))
+		sr.data(c.count)
+		if del := sr.uint64s(); len(del) > 0 {
+			c.del = chunksOf(del, 0)
+		}
+	} else {
+		c.bucketsCount = sr.u32()
+		if sr.err == nil && (c.bucketsCount == 0 || c.bucketsCount > 1<<20) {
+			sr.err = ErrSnapshotFormat
+		}
+		sr.slice(&c.cluster, sr.length(1<<31))
+		c.values = make([][]valEntry, c.bucketsCount)
+		for i := range c.values {
+			if sr.err != nil {
+				break
+			}
+			n := sr.length(1 << 30)
+			bucket := make([]valEntry, 0, sr.capacity(n, 8))
+			for j := 0; j < n && sr.err == nil; j++ {
+				ve := valEntry{rem: sr.u32()}
+				sr.slice(&ve.ids, sr.length(1<<31))
+				c.compress(&ve)
+				bucket = append(bucket, ve)
+			}
+			c.values[i] = bucket
+		}
+	}
+	if sr.err != nil {
+		return nil
+	}
+	c.startWorker()
+	return c
+}
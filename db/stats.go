@@ -0,0 +1,77 @@
+package db
+
+// ColumnStats are statistics of the column for query planning
+type ColumnStats struct {
+	Rows     int // ID со значениями, включая пустые
+	Empty    int // ID с пустым значением
+	Distinct int // размер словаря
+	MinID    IDEntry
+	MaxID    IDEntry
+	Bits     int // бит на значение в биткарте, ID между MinID и MaxID без значения не входят в Rows; 0 - списки ID по значениям
+}
+
+// Stats returns statistics of the column
+func (dt *DataTable) Stats(colname string) (ColumnStats, error) {
+	col, err := dt.column(colname)
+	if err != nil {
+		return ColumnStats{}, err
+	}
+	col.RLock()
+	defer col.RUnlock()
+	return ColumnStats{
+		Rows:     col.rows(),
+		Empty:    col.countOf(col.empty),
+		Distinct: col.dict.Length(),
+		MinID:    col.minId,
+		MaxID:    col.maxId,
+		Bits:     col.bits(),
+	}, nil
+}
+
+func (c *Column) bits() int {
+	switch {
+	case c.use1b:
+		return 1
+	case c.use2b:
+		return 2
+	case c.use4b:
+		return 4
+	case c.use8b:
+		return 8
+	}
+	return 0
+}
+
+// Estimate returns the number of IDs, which would be returned by Select with the same arguments,
+// by the value counts of the column without iterating
+func (dt *DataTable) Estimate(colindex int, where ColumnValue, opts QueryOptions) int {
+	col := dt.columns[colindex]
+
+	if opts.IsRange() {
+		vals := col.dict.SelectRange(where, opts)
+		n := 0
+		col.RLock()
+		for _, v := range vals {
+			if DataEntry(v) != col.empty {
+				n += col.countOf(DataEntry(v))
+			}
+		}
+		col.RUnlock()
+		return n
+	}
+
+	de, ok := col.dict.In(where)
+	if !ok {
+		return 0
+	}
+	col.RLock()
+	defer col.RUnlock()
+	// итератор без данных колонки, только для оценки
+	return int(col.estimate(&ColumnIterator{
+		maxpos:    int32(col.maxId),
+		minpos:    int32(col.minId),
+		useFilter: true,
+		filterVal: DataEntry(de),
+		filterNEQ: opts&SELECT_NEQ != 0,
+	}))
+}
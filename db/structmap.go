@@ -0,0 +1,236 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Размеры колонок по умолчанию для полей без lines= и unique=
+const (
+	DefaultStructLines  = 1024
+	DefaultStructUnique = 1024
+)
+
+var (
+	ErrStructType  = errors.New("value must be a struct or a pointer to struct")
+	ErrFieldType   = errors.New("field type can't be stored in a column")
+	ErrFieldTag    = errors.New("invalid cmemdb field tag")
+	ErrRowNotFound = errors.New("row not found")
+	ErrUintRange   = errors.New("unsigned field value overflows int64")
+)
+
+var columnValueType = reflect.TypeOf((*ColumnValue)(nil)).Elem()
+
+// structField - поле структуры, хранимое в колонке
+type structField struct {
+	index int
+	ct    ColumnType
+}
+
+var structFields sync.Map // reflect.Type -> []structField
+
+// tagColumn returns the column name of the field by `cmemdb:"name,..."` tag or the field name,
+// false for unexported fields and "-"
+func tagColumn(f reflect.StructField) (string, []string, bool) {
+	if f.PkgPath != "" {
+		return "", nil, false
+	}
+	tag, ok := f.Tag.Lookup("cmemdb")
+	if !ok {
+		return f.Name, nil, true
+	}
+	parts := strings.Split(tag, ",")
+	switch parts[0] {
+	case "-":
+		return "", nil, false
+	case "":
+		return f.Name, parts[1:], true
+	}
+	return parts[0], parts[1:], true
+}
+
+func structType(v interface{}) (reflect.Type, error) {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, ErrStructType
+	}
+	return t, nil
+}
+
+// fieldsOf returns stored fields of the struct type with column types by tags
+func fieldsOf(t reflect.Type) ([]structField, error) {
+	if fs, ok := structFields.Load(t); ok {
+		return fs.([]structField), nil
+	}
+	var ret []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, opts, ok := tagColumn(f)
+		if !ok {
+			continue
+		}
+		zero, err := toValue(reflect.Zero(f.Type))
+		if err != nil {
+			return nil, err
+		}
+		sf := structField{
+			index: i,
+			ct: ColumnType{
+				Name:         name,
+				ZeroValue:    zero,
+				Lines:        DefaultStructLines,
+				UniqueValues: DefaultStructUnique,
+			},
+		}
+		for _, opt := range opts {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				return nil, ErrFieldTag
+			}
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n <= 0 {
+				return nil, ErrFieldTag
+			}
+			switch kv[0] {
+			case "lines":
+				sf.ct.Lines = n
+			case "unique":
+				sf.ct.UniqueValues = n
+			default:
+				return nil, ErrFieldTag
+			}
+		}
+		ret = append(ret, sf)
+	}
+	structFields.Store(t, ret)
+	return ret, nil
+}
+
+// toValue converts the field value to the column value: ColumnValue types are stored as is,
+// integers, floats, strings, bools, []byte and time.Time are stored as built-in values.
+// Unsigned values above math.MaxInt64 return ErrUintRange.
+func toValue(v reflect.Value) (ColumnValue, error) {
+	if v.Kind() == reflect.Interface {
+		return nil, ErrFieldType
+	}
+	if v.Type().Implements(columnValueType) {
+		return v.Interface().(ColumnValue), nil
+	}
+	switch kindClass(v.Kind()) {
+	case 1:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return IntValue(v.Int()), nil
+		}
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return nil, ErrUintRange
+		}
+		return IntValue(u), nil
+	case 2:
+		return FloatValue(v.Float()), nil
+	case 3:
+		return StringValue(v.String()), nil
+	case 4:
+		return BoolValue(v.Bool()), nil
+	}
+	switch v.Type() {
+	case bytesType:
+		return NewBytesValue(v.Bytes()), nil
+	case timeType:
+		return TimeValueOf(v.Interface().(time.Time)), nil
+	}
+	return nil, ErrFieldType
+}
+
+// TableFor creates the table with columns for fields of the struct type of sample.
+// Column name, size and number of unique values are taken from `cmemdb:"name,lines=1000,unique=10"` tags.
+func TableFor(sample interface{}) (*DataTable, error) {
+	t, err := structType(sample)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := fieldsOf(t)
+	if err != nil {
+		return nil, err
+	}
+	dt := &DataTable{}
+	for _, sf := range fields {
+		ct := sf.ct
+		dt.AddColumn(&ct)
+	}
+	return dt, nil
+}
+
+// InsertStruct inserts all stored fields of the struct v with the single new ID
+func (dt *DataTable) InsertStruct(v interface{}, opts QueryOptions) (IDEntry, error) {
+	return dt.InsertStructAt(NewIDEntry, v, opts)
+}
+
+// InsertStructAt inserts all stored fields of the struct v with the same ID like InsertRowAt
+func (dt *DataTable) InsertStructAt(id IDEntry, v interface{}, opts QueryOptions) (IDEntry, error) {
+	t, err := structType(v)
+	if err != nil {
+		return id, err
+	}
+	fields, err := fieldsOf(t)
+	if err != nil {
+		return id, err
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	values := make(map[string]ColumnValue, len(fields))
+	for _, sf := range fields {
+		cv, err := toValue(rv.Field(sf.index))
+		if err != nil {
+			return id, err
+		}
+		values[sf.ct.Name] = cv
+	}
+	return dt.InsertRowAt(id, values, opts)
+}
+
+// ScanStruct fills stored fields of the struct by pointer dst with values of the row id like RowIterator.Scan
+func (dt *DataTable) ScanStruct(id IDEntry, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return ErrScanType
+	}
+	fields, err := fieldsOf(rv.Elem().Type())
+	if err != nil {
+		return err
+	}
+	rv = rv.Elem()
+	found := false
+	for _, sf := range fields {
+		col, err := dt.column(sf.ct.Name)
+		if err != nil {
+			return err
+		}
+		col.RLock()
+		de := NullEntry
+		if id >= col.minId && id <= col.maxId {
+			de = col.Get(id)
+		}
+		col.RUnlock()
+		var cv ColumnValue
+		if de != NullEntry {
+			cv = col.FromDictonary(de)
+			found = true
+		}
+		if err := setField(rv.Field(sf.index), cv); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return ErrRowNotFound
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"errors"
+	"sort"
+)
+
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// txOp - буферизованная операция транзакции
+type txOp struct {
+	id   IDEntry
+	del  bool
+	idxs []int // по возрастанию
+	vals []ColumnValue
+	opts QueryOptions
+}
+
+// txRow - состояние строки, измененной в транзакции
+type txRow struct {
+	deleted bool                // строка удалена в транзакции, значения вне vals пустые
+	vals    map[int]ColumnValue // записанные в транзакции значения по индексам колонок
+}
+
+// Tx buffers changes of the table until Commit, they are not visible to other readers before it.
+// Tx is not safe for concurrent use, columns must not be added or dropped while it is active.
+type Tx struct {
+	dt   *DataTable
+	ops  []txOp
+	rows map[IDEntry]*txRow
+}
+
+// Begin starts a transaction
+func (dt *DataTable) Begin() *Tx {
+	return &Tx{
+		dt:   dt,
+		rows: make(map[IDEntry]*txRow),
+	}
+}
+
+func (tx *Tx) row(id IDEntry) *txRow {
+	row, ok := tx.rows[id]
+	if !ok {
+		row = &txRow{
+			vals: make(map[int]ColumnValue),
+		}
+		tx.rows[id] = row
+	}
+	return row
+}
+
+// Insert buffers the value of one column, NewIDEntry allocates the next table-wide ID at once.
+// INSERT_ASYNC is ignored.
+func (tx *Tx) Insert(colindex int, id IDEntry, val ColumnValue, opts QueryOptions) IDEntry {
+	id, _ = tx.insertRow(id, []int{colindex}, []ColumnValue{val}, opts)
+	return id
+}
+
+// InsertRow buffers values of the columns by names with the single new ID
+func (tx *Tx) InsertRow(values map[string]ColumnValue, opts QueryOptions) (IDEntry, error) {
+	return tx.InsertRowAt(NewIDEntry, values, opts)
+}
+
+// InsertRowAt buffers values of the columns by names with the same ID
+func (tx *Tx) InsertRowAt(id IDEntry, values map[string]ColumnValue, opts QueryOptions) (IDEntry, error) {
+	if tx.dt == nil {
+		return id, ErrTxDone
+	}
+	idxs := make([]int, 0, len(values))
+	for name := range values {
+		colidx, ok := tx.dt.names[name]
+		if !ok {
+			return id, ErrColumnNotFound
+		}
+		idxs = append(idxs, colidx)
+	}
+	sort.Ints(idxs)
+	vals := make([]ColumnValue, len(idxs))
+	for i, colidx := range idxs {
+		vals[i] = values[tx.dt.metadata[colidx].Name]
+	}
+	return tx.insertRow(id, idxs, vals, opts)
+}
+
+func (tx *Tx) insertRow(id IDEntry, idxs []int, vals []ColumnValue, opts QueryOptions) (IDEntry, error) {
+	if tx.dt == nil {
+		return id, ErrTxDone
+	}
+	if id == NewIDEntry {
+		id = tx.dt.newID()
+	}
+	tx.ops = append(tx.ops, txOp{
+		id:   id,
+		idxs: idxs,
+		vals: vals,
+		opts: opts &^ INSERT_ASYNC,
+	})
+	row := tx.row(id)
+	for i, colidx := range idxs {
+		row.vals[colidx] = vals[i]
+	}
+	return id, nil
+}
+
+// DeleteRow buffers removal of id from all columns
+func (tx *Tx) DeleteRow(id IDEntry) error {
+	if tx.dt == nil {
+		return ErrTxDone
+	}
+	tx.ops = append(tx.ops, txOp{
+		id:  id,
+		del: true,
+	})
+	row := tx.row(id)
+	row.deleted = true
+	row.vals = make(map[int]ColumnValue)
+	return nil
+}
+
+// matchValue checks v like Select with the same options, nil is the zero value
+func matchValue(v, zero, where ColumnValue, opts QueryOptions) bool {
+	if v == nil {
+		v = zero
+	}
+	switch {
+	case opts.IsRange():
+		return v != zero && opts.MatchRange(v.Compare(where))
+	case opts&SELECT_NEQ != 0:
+		return v != zero && v != where
+	}
+	return v == where
+}
+
+// Select is like DataTable.Select, but with changes made in the transaction
+func (tx *Tx) Select(colindex int, where ColumnValue, opts QueryOptions) IDIterator {
+	if tx.dt == nil {
+		return nil
+	}
+	base := tx.dt.Select(colindex, where, opts)
+	reverse := opts&SELECT_DESC != 0
+	zero := tx.dt.metadata[colindex].ZeroValue
+
+	var changed, matched []IDEntry
+	for id, row := range tx.rows {
+		v, ok := row.vals[colindex]
+		if !ok && !row.deleted {
+			continue
+		}
+		changed = append(changed, id)
+		if ok && matchValue(v, zero, where, opts) {
+			matched = append(matched, id)
+		}
+	}
+	if len(changed) == 0 {
+		return base
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i] < changed[j] })
+	sort.Slice(matched, func(i, j int) bool { return matched[i] < matched[j] })
+
+	iters := make([]IDIterator, 0, 2)
+	if base != nil {
+		iters = append(iters, tx.dt.Sub(base, NewIteratorByIds(changed, reverse)))
+	}
+	if len(matched) > 0 {
+		iters = append(iters, NewIteratorByIds(matched, reverse))
+	}
+	switch len(iters) {
+	case 0:
+		return nil
+	case 1:
+		return iters[0]
+	}
+	return NewIteratorMerge(iters...)
+}
+
+func (tx *Tx) SelectN(colname string, where ColumnValue, opts QueryOptions) IDIterator {
+	if tx.dt == nil {
+		return nil
+	}
+	colidx, ok := tx.dt.names[colname]
+	if !ok {
+		return nil
+	}
+	return tx.Select(colidx, where, opts)
+}
+
+// Commit applies all changes at once with all columns locked and writes them to WAL in one record
+func (tx *Tx) Commit() error {
+	dt := tx.dt
+	if dt == nil {
+		return ErrTxDone
+	}
+	tx.dt = nil
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	dt.walmu.RLock()
+	defer dt.walmu.RUnlock()
+	if dt.closed {
+		return ErrTableClosed
+	}
+	dt.flush()
+
+	for _, col := range dt.columns {
+		col.Lock()
+	}
+	defer func() {
+		for _, col := range dt.columns {
+			col.Unlock()
+		}
+	}()
+
+	if dt.wal != nil {
+		if err := dt.wal.logTx(tx.ops); err != nil {
+			return err
+		}
+	}
+
+	for _, op := range tx.ops {
+		if op.del {
+			for _, col := range dt.columns {
+				col.Remove(op.id)
+			}
+			continue
+		}
+		dt.useID(op.id)
+		upd := op.opts&INSERT_UPDATE != 0
+		for i, colidx := range op.idxs {
+			dt.columns[colidx].SetVal(op.id, op.vals[i], upd, false)
+		}
+	}
+	return nil
+}
+
+// Rollback discards all changes, allocated IDs are not reused
+func (tx *Tx) Rollback() {
+	tx.dt = nil
+	tx.ops = nil
+	tx.rows = nil
+}
@@ -1,8 +1,10 @@
 package db
 
 import (
+	"encoding/hex"
 	"errors"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -94,3 +96,124 @@ func (ts *TimeStamp) UnmarshalJSON(data []byte) error {
 	*ts = TimeStamp(data)
 	return ts.Validate()
 }
+
+// Built-in column values, they have registered codecs for snapshots and WAL
+
+type IntValue int64
+
+func (v IntValue) Compare(o ColumnValue) int {
+	ov := o.(IntValue)
+	switch {
+	case v < ov:
+		return -1
+	case v > ov:
+		return 1
+	}
+	return 0
+}
+
+func (v IntValue) String() string {
+	return strconv.FormatInt(int64(v), 10)
+}
+
+func (v IntValue) Float64() float64 {
+	return float64(v)
+}
+
+type FloatValue float64
+
+func (v FloatValue) Compare(o ColumnValue) int {
+	ov := o.(FloatValue)
+	switch {
+	case v < ov:
+		return -1
+	case v > ov:
+		return 1
+	}
+	return 0
+}
+
+func (v FloatValue) String() string {
+	return strconv.FormatFloat(float64(v), 'g', -1, 64)
+}
+
+func (v FloatValue) Float64() float64 {
+	return float64(v)
+}
+
+type StringValue string
+
+func (v StringValue) Compare(o ColumnValue) int {
+	return strings.Compare(string(v), string(o.(StringValue)))
+}
+
+func (v StringValue) String() string {
+	return string(v)
+}
+
+// BoolValue false is less than true
+type BoolValue bool
+
+func (v BoolValue) Compare(o ColumnValue) int {
+	ov := o.(BoolValue)
+	switch {
+	case v == ov:
+		return 0
+	case bool(ov):
+		return -1
+	}
+	return 1
+}
+
+func (v BoolValue) String() string {
+	return strconv.FormatBool(bool(v))
+}
+
+// BytesValue holds bytes in a string, because values must be comparable to be the dictonary keys
+type BytesValue string
+
+func NewBytesValue(b []byte) BytesValue {
+	return BytesValue(b)
+}
+
+func (v BytesValue) Bytes() []byte {
+	return []byte(v)
+}
+
+func (v BytesValue) Compare(o ColumnValue) int {
+	return strings.Compare(string(v), string(o.(BytesValue)))
+}
+
+func (v BytesValue) String() string {
+	return hex.EncodeToString([]byte(v))
+}
+
+// TimeValue is unix time in seconds
+type TimeValue int64
+
+func TimeValueOf(t time.Time) TimeValue {
+	return TimeValue(t.Unix())
+}
+
+func (ts TimeStamp) Value() TimeValue {
+	return TimeValue(ts.Int())
+}
+
+func (v TimeValue) Time() time.Time {
+	return time.Unix(int64(v), 0).UTC()
+}
+
+func (v TimeValue) Compare(o ColumnValue) int {
+	ov := o.(TimeValue)
+	switch {
+	case v < ov:
+		return -1
+	case v > ov:
+		return 1
+	}
+	return 0
+}
+
+func (v TimeValue) String() string {
+	return v.Time().Format(time.RFC3339)
+}
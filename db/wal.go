@@ -0,0 +1,573 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type SyncPolicy uint8
+
+const (
+	SyncAlways   SyncPolicy = iota // fsync after every record
+	SyncInterval                   // fsync in background every WALOptions.Interval
+	SyncNone                       // leave it to the OS
+)
+
+type WALOptions struct {
+	Sync     SyncPolicy
+	Interval time.Duration // for SyncInterval, default is 1s
+
+	// Dictonaries shared with other tables opened with the same map, see ReadDataTableShared
+	Dictonaries map[uint64]*Dictonary
+}
+
+const (
+	walAddColumn byte = iota + 1
+	walInsert
+	walDelete
+	walDropColumn
+	walTx
+	walFormat // формат значений следующих записей, не занимает номер
+)
+
+var (
+	ErrWALClosed   = errors.New("wal is closed")
+	ErrWALAttached = errors.New("table already has a wal")
+)
+
+// WAL is append-only write-ahead log of DataTable changes.
+// Record frame is: payload length, crc32 of payload, payload with sequence number.
+type WAL struct {
+	mu    sync.Mutex
+	f     *os.File
+	opts  WALOptions
+	seq   uint64 // последний записанный номер
+	dirty bool   // есть записи без fsync
+	err   error  // первая ошибка записи
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// OpenWAL opens or creates the log file, a torn record at the end of file is truncated
+func OpenWAL(path string, opts WALOptions) (*WAL, error) {
+	if opts.Sync == SyncInterval && opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		f:    f,
+		opts: opts,
+	}
+	var end int64
+	format := valGob
+	err = w.scan(func(seq uint64, pos int64, payload []byte) error {
+		w.seq = seq
+		end = pos
+		if payload[0] == walFormat && len(payload) == 2 {
+			format = payload[1]
+		}
+		return nil
+	})
+	if err == nil {
+		err = f.Truncate(end)
+	}
+	if err == nil {
+		_, err = f.Seek(end, io.SeekStart)
+	}
+	// журнал прежнего формата дописываем после записи с новым форматом
+	if err == nil && (end == 0 || format != valCodec) {
+		err = w.writeFormat()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if opts.Sync == SyncInterval {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncer()
+	}
+	return w, nil
+}
+
+// scan calls f for every valid record from the start of file with the end position of the record
+func (w *WAL) scan(f func(seq uint64, pos int64, payload []byte) error) error {
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(w.f)
+	var hdr [8]byte
+	pos := int64(0)
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil
+		}
+		ln := binary.LittleEndian.Uint32(hdr[:4])
+		if ln < 9 || ln > 1<<30 {
+			return nil
+		}
+		payload := make([]byte, ln)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(hdr[4:]) {
+			return nil
+		}
+		pos += int64(len(hdr)) + int64(ln)
+		if err := f(binary.LittleEndian.Uint64(payload), pos, payload[8:]); err != nil {
+			return err
+		}
+	}
+}
+
+func (w *WAL) syncer() {
+	t := time.NewTicker(w.opts.Interval)
+	defer t.Stop()
+	defer close(w.done)
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+			w.mu.Lock()
+			if w.dirty && w.f != nil {
+				if err := w.f.Sync(); err != nil && w.err == nil {
+					w.err = err
+				}
+				w.dirty = false
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// Err returns the first write error, e.g. of DataTable.Insert, which doesn't return errors
+func (w *WAL) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close syncs and closes the log file
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return ErrWALClosed
+	}
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f = nil
+	return err
+}
+
+// append writes one record, the record is applied on replay entirely or not at all
+func (w *WAL) append(op byte, enc func(sw *snapWriter)) error {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 16)) // заголовок и номер
+	sw := &snapWriter{w: bufio.NewWriter(&buf)}
+	sw.u8(op)
+	enc(sw)
+	if sw.err == nil {
+		sw.err = sw.w.Flush()
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return ErrWALClosed
+	}
+
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint64(b[8:], w.seq+1)
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(b)-8))
+	binary.LittleEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(b[8:]))
+	if _, err := w.f.Write(b); err != nil {
+		if w.err == nil {
+			w.err = err
+		}
+		return err
+	}
+	w.seq++
+	switch w.opts.Sync {
+	case SyncAlways:
+		if err := w.f.Sync(); err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return err
+		}
+	case SyncInterval:
+		w.dirty = true
+	}
+	return nil
+}
+
+// writeFormat writes the record with the format of following values, it has the last sequence number
+func (w *WAL) writeFormat() error {
+	var b [18]byte
+	binary.LittleEndian.PutUint64(b[8:], w.seq)
+	b[16], b[17] = walFormat, valCodec
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(b)-8))
+	binary.LittleEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(b[8:]))
+	_, err := w.f.Write(b[:])
+	return err
+}
+
+func (w *WAL) logInsert(id IDEntry, idxs []int, vals []ColumnValue, opts QueryOptions) error {
+	return w.append(walInsert, func(sw *snapWriter) {
+		w.writeInsert(sw, id, idxs, vals, opts)
+	})
+}
+
+func (w *WAL) writeInsert(sw *snapWriter, id IDEntry, idxs []int, vals []ColumnValue, opts QueryOptions) {
+	sw.u32(uint32(id))
+	sw.u8(byte(opts))
+	sw.u32(uint32(len(idxs)))
+	for i, colidx := range idxs {
+		sw.u32(uint32(colidx))
+		sw.value(vals[i])
+	}
+}
+
+func (w *WAL) readInsert(sr *snapReader, ncols int) txOp {
+	op := txOp{
+		id:   IDEntry(sr.u32()),
+		opts: QueryOptions(sr.u8()),
+	}
+	n := sr.length(uint32(ncols))
+	op.idxs = make([]int, n)
+	op.vals = make([]ColumnValue, n)
+	for i := range op.idxs {
+		op.idxs[i] = sr.length(uint32(ncols))
+		op.vals[i] = sr.value()
+		if sr.err == nil && op.idxs[i] >= ncols {
+			sr.err = ErrSnapshotFormat
+		}
+	}
+	return op
+}
+
+func (w *WAL) logDelete(id IDEntry) error {
+	return w.append(walDelete, func(sw *snapWriter) {
+		sw.u32(uint32(id))
+	})
+}
+
+// logTx writes all operations of the transaction in one record
+func (w *WAL) logTx(ops []txOp) error {
+	return w.append(walTx, func(sw *snapWriter) {
+		sw.u32(uint32(len(ops)))
+		for _, op := range ops {
+			if op.del {
+				sw.u8(walDelete)
+				sw.u32(uint32(op.id))
+			} else {
+				sw.u8(walInsert)
+				w.writeInsert(sw, op.id, op.idxs, op.vals, op.opts)
+			}
+		}
+	})
+}
+
+func (w *WAL) logAddColumn(dt *DataTable, idx int) error {
+	ct, col := dt.metadata[idx], dt.columns[idx]
+	// колонка с общим словарем ссылается на первую колонку с этим словарем
+	shared := idx
+	for i, c := range dt.columns[:idx] {
+		if c.dict == col.dict {
+			shared = i
+			break
+		}
+	}
+	return w.append(walAddColumn, func(sw *snapWriter) {
+		sw.str(ct.Name)
+		sw.u32(uint32(ct.Lines))
+		sw.u32(uint32(ct.UniqueValues))
+		sw.u32(uint32(shared))
+		sw.value(ct.ZeroValue)
+		if ct.Dictonary != nil {
+			sw.u64(ct.Dictonary.id)
+		}
+	})
+}
+
+func (w *WAL) logDropColumn(idx int) error {
+	return w.append(walDropColumn, func(sw *snapWriter) {
+		sw.u32(uint32(idx))
+	})
+}
+
+// Replay applies records after the last applied sequence number of the table, e.g. from snapshot.
+// The table must not have attached WAL.
+func (w *WAL) Replay(dt *DataTable) error {
+	if dt.wal != nil {
+		return ErrWALAttached
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return ErrWALClosed
+	}
+	defer w.f.Seek(0, io.SeekEnd)
+
+	format := valGob
+	return w.scan(func(seq uint64, pos int64, payload []byte) error {
+		if payload[0] == walFormat {
+			if len(payload) != 2 || payload[1] > valCodec {
+				return ErrSnapshotFormat
+			}
+			format = payload[1]
+			return nil
+		}
+		if seq <= dt.walSeq {
+			return nil
+		}
+		if err := w.apply(dt, payload, format); err != nil {
+			return fmt.Errorf("wal record %d at offset %d: %w", seq, pos, err)
+		}
+		dt.walSeq = seq
+		return nil
+	})
+}
+
+func (w *WAL) apply(dt *DataTable, payload []byte, format byte) error {
+	sr := &snapReader{r: bufio.NewReader(bytes.NewReader(payload)), format: format, sized: true, left: int64(len(payload))}
+	switch sr.u8() {
+	case walAddColumn:
+		ct := &ColumnType{
+			Name:         sr.str(),
+			Lines:        int(sr.u32()),
+			UniqueValues: int(sr.u32()),
+		}
+		shared := sr.length(uint32(len(dt.columns)))
+		ct.ZeroValue = sr.value()
+		var id uint64 // идентичность общего словаря, ее нет в записях колонок с собственным словарем
+		if sr.left >= 8 {
+			id = sr.u64()
+		}
+		if sr.err != nil {
+			return sr.err
+		}
+		switch {
+		case shared < len(dt.columns):
+			ct.Dictonary = dt.columns[shared].dict
+		case id != 0:
+			ct.Dictonary = w.opts.Dictonaries[id]
+			if ct.Dictonary == nil {
+				ct.Dictonary = NewDictonary(ct.UniqueValues)
+				ct.Dictonary.id = id
+				if w.opts.Dictonaries != nil {
+					w.opts.Dictonaries[id] = ct.Dictonary
+				}
+			}
+		}
+		dt.AddColumn(ct)
+	case walInsert:
+		op := w.readInsert(sr, len(dt.columns))
+		if sr.err != nil {
+			return sr.err
+		}
+		if _, err := dt.insertRow(op.id, op.idxs, op.vals, op.opts&^INSERT_ASYNC); err != nil {
+			return err
+		}
+	case walTx:
+		ops := make([]txOp, sr.length(1<<30))
+		for i := range ops {
+			switch sr.u8() {
+			case walInsert:
+				ops[i] = w.readInsert(sr, len(dt.columns))
+			case walDelete:
+				ops[i] = txOp{id: IDEntry(sr.u32()), del: true}
+			default:
+				if sr.err == nil {
+					sr.err = ErrSnapshotFormat
+				}
+			}
+			if sr.err != nil {
+				return sr.err
+			}
+		}
+		for _, op := range ops {
+			var err error
+			if op.del {
+				err = dt.DeleteRow(op.id)
+			} else {
+				_, err = dt.insertRow(op.id, op.idxs, op.vals, op.opts&^INSERT_ASYNC)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case walDropColumn:
+		idx := sr.length(uint32(len(dt.columns)))
+		if sr.err == nil && idx >= len(dt.columns) {
+			sr.err = ErrSnapshotFormat
+		}
+		if sr.err != nil {
+			return sr.err
+		}
+		return dt.DropColumn(dt.metadata[idx].Name)
+	case walDelete:
+		id := IDEntry(sr.u32())
+		if sr.err != nil {
+			return sr.err
+		}
+		return dt.DeleteRow(id)
+	default:
+		if sr.err != nil {
+			return sr.err
+		}
+		return ErrSnapshotFormat
+	}
+	return nil
+}
+
+// reset truncates the log after checkpoint, sequence numbers continue
+func (w *WAL) reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return ErrWALClosed
+	}
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := w.writeFormat(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+func (dt *DataTable) lastSeq() uint64 {
+	if dt.wal != nil {
+		dt.wal.mu.Lock()
+		defer dt.wal.mu.Unlock()
+		return dt.wal.seq
+	}
+	return dt.walSeq
+}
+
+// AttachWAL makes the table to log all changes to w, w must be replayed before
+func (dt *DataTable) AttachWAL(w *WAL) error {
+	if dt.wal != nil {
+		return ErrWALAttached
+	}
+	w.mu.Lock()
+	if w.seq < dt.walSeq {
+		w.seq = dt.walSeq
+	}
+	w.mu.Unlock()
+	dt.wal = w
+	return nil
+}
+
+// OpenDataTable loads the snapshot, if it exists, replays the log on top of it and attaches the log to the table
+func OpenDataTable(snapshotPath, walPath string, opts WALOptions) (*DataTable, error) {
+	w, err := OpenWAL(walPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dt := &DataTable{}
+	f, err := os.Open(snapshotPath)
+	if err == nil {
+		dt, err = ReadDataTableShared(f, w.opts.Dictonaries)
+		f.Close()
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil {
+		err = w.Replay(dt)
+	}
+	if err == nil {
+		err = dt.AttachWAL(w)
+	}
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return dt, nil
+}
+
+// Checkpoint atomically replaces the snapshot file and truncates the attached log.
+// Queued INSERT_ASYNC writes are applied before.
+func (dt *DataTable) Checkpoint(snapshotPath string) error {
+	dt.walmu.Lock()
+	defer dt.walmu.Unlock()
+	if dt.closed {
+		return ErrTableClosed
+	}
+
+	dt.flush()
+
+	dt.rlockColumns()
+	defer dt.runlockColumns()
+
+	tmp := snapshotPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = dt.writeSnapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, snapshotPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// переименование должно дойти до диска раньше очистки журнала
+	if err := syncDir(filepath.Dir(snapshotPath)); err != nil {
+		return err
+	}
+	if dt.wal != nil {
+		return dt.wal.reset()
+	}
+	return nil
+}
+
+// syncDir flushes the directory entries, so the renamed file survives the power loss
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
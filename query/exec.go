@@ -0,0 +1,176 @@
+package query
+
+import (
+	"errors"
+	"time"
+
+	"github.com/covrom/cmemdb/db"
+)
+
+var (
+	ErrTableNotFound = errors.New("query: table not found")
+	ErrLiteralType   = errors.New("query: value doesn't match the column type")
+)
+
+// Tables are tables available to queries by names
+type Tables map[string]*db.DataTable
+
+// Query parses and executes the SELECT statement
+func (ts Tables) Query(s string) (*db.RowIterator, error) {
+	q, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	dt, ok := ts[q.Table]
+	if !ok {
+		return nil, ErrTableNotFound
+	}
+	return q.Exec(dt)
+}
+
+// Exec executes the query on the table, q.Table is not checked
+func (q *Query) Exec(dt *db.DataTable) (*db.RowIterator, error) {
+	for _, col := range q.Columns {
+		if _, err := dt.ColumnType(col); err != nil {
+			return nil, err
+		}
+	}
+	iter, err := q.Filter(dt)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case q.OrderBy != "":
+		if iter, err = dt.OrderBy(iter, q.OrderBy, q.Desc, q.Limit, q.Offset); err != nil {
+			return nil, err
+		}
+	case iter != nil && (q.Limit > 0 || q.Offset > 0):
+		iter = &limitIterator{IDIterator: iter, limit: q.Limit, offset: q.Offset}
+	}
+	return dt.Fetch(iter, q.Columns...), nil
+}
+
+// Filter returns IDs of the rows matching WHERE, nil if there are no such rows
+func (q *Query) Filter(dt *db.DataTable) (db.IDIterator, error) {
+	if q.Where == nil {
+		return allRows(dt), nil
+	}
+	p, err := q.Plan(dt)
+	if err != nil {
+		return nil, err
+	}
+	pl := &planner{dt: dt}
+	return pl.build(p), nil
+}
+
+// allRows returns IDs having a not empty value in any column
+func allRows(dt *db.DataTable) db.IDIterator {
+	var iters []db.IDIterator
+	for _, ct := range dt.ColumnTypes() {
+		if it := dt.Select(ct.Index, ct.ZeroValue, db.SELECT_NEQ); it != nil {
+			iters = append(iters, it)
+		}
+	}
+	return or(dt, iters)
+}
+
+func or(dt *db.DataTable, iters []db.IDIterator) db.IDIterator {
+	switch len(iters) {
+	case 0:
+		return nil
+	case 1:
+		return iters[0]
+	}
+	return dt.Or(iters...)
+}
+
+// columnValue converts the literal to the type of the column zero value
+func columnValue(lit interface{}, zero db.ColumnValue) (db.ColumnValue, error) {
+	switch zero.(type) {
+	case db.IntValue:
+		if n, ok := lit.(int64); ok {
+			return db.IntValue(n), nil
+		}
+	case db.FloatValue:
+		switch x := lit.(type) {
+		case int64:
+			return db.FloatValue(x), nil
+		case float64:
+			return db.FloatValue(x), nil
+		}
+	case db.StringValue:
+		if s, ok := lit.(string); ok {
+			return db.StringValue(s), nil
+		}
+	case db.BytesValue:
+		if s, ok := lit.(string); ok {
+			return db.BytesValue(s), nil
+		}
+	case db.BoolValue:
+		if b, ok := lit.(bool); ok {
+			return db.BoolValue(b), nil
+		}
+	case db.TimeValue:
+		switch x := lit.(type) {
+		case int64:
+			return db.TimeValue(x), nil
+		case string:
+			t, err := time.Parse(time.RFC3339, x)
+			if err != nil {
+				return nil, err
+			}
+			return db.TimeValueOf(t), nil
+		}
+	}
+	return nil, ErrLiteralType
+}
+
+// limitIterator skips offset IDs and stops after limit IDs, limit 0 means no limit
+type limitIterator struct {
+	db.IDIterator
+	limit, offset int
+	n             int
+}
+
+func (iter *limitIterator) Clone() db.IDIterator {
+	rv := &limitIterator{}
+	*rv = *iter
+	rv.IDIterator = iter.IDIterator.Clone()
+	return rv
+}
+
+func (iter *limitIterator) HasNext() bool {
+	for iter.offset > 0 {
+		if !iter.IDIterator.HasNext() {
+			return false
+		}
+		iter.offset--
+	}
+	if iter.limit > 0 && iter.n >= iter.limit {
+		return false
+	}
+	if !iter.IDIterator.HasNext() {
+		return false
+	}
+	iter.n++
+	return true
+}
+
+func (iter *limitIterator) EstimatedCardinality() int {
+	return iter.bound(iter.IDIterator.EstimatedCardinality() - iter.offset)
+}
+
+func (iter *limitIterator) ExactCount() int {
+	return iter.bound(iter.IDIterator.ExactCount() - iter.offset)
+}
+
+// bound cuts the number of IDs by the rest of the limit
+func (iter *limitIterator) bound(n int) int {
+	if iter.limit > 0 && n > iter.limit-iter.n {
+		n = iter.limit - iter.n
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
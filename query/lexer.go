@@ -0,0 +1,161 @@
+// Package query is a small SQL-like front end for db.DataTable:
+//
+//	SELECT a, b FROM t WHERE a = 1 AND (b = 'x' OR c != 3) ORDER BY d DESC LIMIT 10 OFFSET 20
+//
+// WHERE is compiled into trees of db.DataTable Select, And, Or and Sub iterators.
+package query
+
+import (
+	"strconv"
+	"strings"
+)
+
+type tokenKind uint8
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokKeyword
+	tokNumber
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+	tokStar
+)
+
+var keywords = map[string]bool{
+	"SELECT": true,
+	"FROM":   true,
+	"WHERE":  true,
+	"AND":    true,
+	"OR":     true,
+	"NOT":    true,
+	"ORDER":  true,
+	"BY":     true,
+	"ASC":    true,
+	"DESC":   true,
+	"LIMIT":  true,
+	"OFFSET": true,
+	"TRUE":   true,
+	"FALSE":  true,
+}
+
+type token struct {
+	kind tokenKind
+	text string // ключевые слова в верхнем регистре, строки без кавычек
+	pos  int
+}
+
+// SyntaxError reports the position in the query, where it can't be parsed
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return "query: " + e.Msg + " at " + strconv.Itoa(e.Pos)
+}
+
+// lex splits the query into tokens, the last one is tokEOF
+func lex(s string) ([]token, error) {
+	var ret []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case isLetter(c):
+			j := i + 1
+			for j < len(s) && (isLetter(s[j]) || isDigit(s[j])) {
+				j++
+			}
+			word := s[i:j]
+			if up := strings.ToUpper(word); keywords[up] {
+				ret = append(ret, token{tokKeyword, up, i})
+			} else {
+				ret = append(ret, token{tokIdent, word, i})
+			}
+			i = j
+
+		case isDigit(c) || (c == '.' && i+1 < len(s) && isDigit(s[i+1])):
+			j := i
+			for j < len(s) && (isDigit(s[j]) || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				((s[j] == '+' || s[j] == '-') && (s[j-1] == 'e' || s[j-1] == 'E'))) {
+				j++
+			}
+			ret = append(ret, token{tokNumber, s[i:j], i})
+			i = j
+
+		case c == '\'' || c == '"':
+			// 'строка' или "идентификатор", кавычка внутри удваивается
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= len(s) {
+					return nil, &SyntaxError{i, "unterminated quote"}
+				}
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						sb.WriteByte(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(s[j])
+				j++
+			}
+			kind := tokString
+			if c == '"' {
+				kind = tokIdent
+			}
+			ret = append(ret, token{kind, sb.String(), i})
+			i = j + 1
+
+		case c == '=':
+			ret = append(ret, token{tokOp, "=", i})
+			i++
+		case c == '!' || c == '<' || c == '>':
+			op := s[i : i+1]
+			if i+1 < len(s) && (s[i+1] == '=' || (c == '<' && s[i+1] == '>')) {
+				op = s[i : i+2]
+			}
+			if op == "!" {
+				return nil, &SyntaxError{i, "unexpected !"}
+			}
+			ret = append(ret, token{tokOp, op, i})
+			i += len(op)
+		case c == '-':
+			// знак числа
+			ret = append(ret, token{tokOp, "-", i})
+			i++
+		case c == '(':
+			ret = append(ret, token{tokLParen, "(", i})
+			i++
+		case c == ')':
+			ret = append(ret, token{tokRParen, ")", i})
+			i++
+		case c == ',':
+			ret = append(ret, token{tokComma, ",", i})
+			i++
+		case c == '*':
+			ret = append(ret, token{tokStar, "*", i})
+			i++
+		default:
+			return nil, &SyntaxError{i, "unexpected " + strconv.QuoteRune(rune(c))}
+		}
+	}
+	return append(ret, token{tokEOF, "", len(s)}), nil
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,336 @@
+package query
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/covrom/cmemdb/db"
+)
+
+// Query is a parsed SELECT statement
+type Query struct {
+	Columns []string // nil для SELECT *
+	Table   string
+	Where   Expr // nil без WHERE
+	OrderBy string
+	Desc    bool
+	Limit   int // 0 - без ограничения
+	Offset  int
+}
+
+// Expr is a WHERE condition: *Cond, And, Or or *Not
+type Expr interface {
+	String() string
+}
+
+// Cond compares the column with the literal, Value is int64, float64, string or bool
+type Cond struct {
+	Col   string
+	Op    db.QueryOptions // 0 для =, SELECT_NEQ, SELECT_LT, SELECT_LTE, SELECT_GT, SELECT_GTE
+	Value interface{}
+}
+
+// And is true, if all conditions are true
+type And []Expr
+
+// Or is true, if any of conditions is true
+type Or []Expr
+
+// Not is true for rows without Expr
+type Not struct {
+	Expr Expr
+}
+
+var ops = map[string]db.QueryOptions{
+	"=":  0,
+	"!=": db.SELECT_NEQ,
+	"<>": db.SELECT_NEQ,
+	"<":  db.SELECT_LT,
+	"<=": db.SELECT_LTE,
+	">":  db.SELECT_GT,
+	">=": db.SELECT_GTE,
+}
+
+func opString(op db.QueryOptions) string {
+	for s, o := range ops {
+		if o == op && s != "<>" {
+			return s
+		}
+	}
+	return "="
+}
+
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func (c *Cond) String() string {
+	var v string
+	switch x := c.Value.(type) {
+	case string:
+		v = quote(x)
+	case int64:
+		v = strconv.FormatInt(x, 10)
+	case float64:
+		v = strconv.FormatFloat(x, 'g', -1, 64)
+	case bool:
+		v = strings.ToUpper(strconv.FormatBool(x))
+	}
+	return c.Col + " " + opString(c.Op) + " " + v
+}
+
+func joinExprs(es []Expr, sep string) string {
+	parts := make([]string, len(es))
+	for i, e := range es {
+		parts[i] = e.String()
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+func (a And) String() string  { return joinExprs(a, " AND ") }
+func (o Or) String() string   { return joinExprs(o, " OR ") }
+func (n *Not) String() string { return "NOT " + n.Expr.String() }
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+// Parse parses the SELECT statement
+func Parse(s string) (*Query, error) {
+	toks, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	return p.query()
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(msg string) error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return &SyntaxError{t.pos, msg + ", got end of query"}
+	}
+	return &SyntaxError{t.pos, msg + ", got " + strconv.Quote(t.text)}
+}
+
+// keyword skips the keyword, if it is the next token
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokKeyword && t.text == kw {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.keyword(kw) {
+		return p.errorf("expected " + kw)
+	}
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	if t := p.peek(); t.kind == tokIdent {
+		p.pos++
+		return t.text, nil
+	}
+	return "", p.errorf("expected name")
+}
+
+func (p *parser) integer() (int, error) {
+	t := p.peek()
+	if t.kind == tokNumber {
+		if n, err := strconv.Atoi(t.text); err == nil && n >= 0 {
+			p.pos++
+			return n, nil
+		}
+	}
+	return 0, p.errorf("expected non-negative integer")
+}
+
+func (p *parser) query() (*Query, error) {
+	q := &Query{}
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == tokStar {
+		p.next()
+	} else {
+		for {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			q.Columns = append(q.Columns, col)
+			if p.peek().kind != tokComma {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	q.Table = table
+
+	if p.keyword("WHERE") {
+		if q.Where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if q.OrderBy, err = p.ident(); err != nil {
+			return nil, err
+		}
+		if p.keyword("DESC") {
+			q.Desc = true
+		} else {
+			p.keyword("ASC")
+		}
+	}
+	if p.keyword("LIMIT") {
+		if q.Limit, err = p.integer(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("OFFSET") {
+		if q.Offset, err = p.integer(); err != nil {
+			return nil, err
+		}
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected token")
+	}
+	return q, nil
+}
+
+func (p *parser) or() (Expr, error) {
+	var ret Or
+	for {
+		e, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, e)
+		if !p.keyword("OR") {
+			break
+		}
+	}
+	if len(ret) == 1 {
+		return ret[0], nil
+	}
+	return ret, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	var ret And
+	for {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, e)
+		if !p.keyword("AND") {
+			break
+		}
+	}
+	if len(ret) == 1 {
+		return ret[0], nil
+	}
+	return ret, nil
+}
+
+func (p *parser) unary() (Expr, error) {
+	if p.keyword("NOT") {
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{e}, nil
+	}
+	if p.peek().kind == tokLParen {
+		p.next()
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			return nil, p.errorf("expected )")
+		}
+		p.next()
+		return e, nil
+	}
+
+	col, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	op, ok := ops[t.text]
+	if t.kind != tokOp || !ok {
+		return nil, p.errorf("expected comparison")
+	}
+	p.next()
+	v, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	return &Cond{Col: col, Op: op, Value: v}, nil
+}
+
+func (p *parser) literal() (interface{}, error) {
+	neg := false
+	if t := p.peek(); t.kind == tokOp && t.text == "-" {
+		p.next()
+		neg = true
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokNumber:
+		p.next()
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			if neg {
+				n = -n
+			}
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &SyntaxError{t.pos, "invalid number " + strconv.Quote(t.text)}
+		}
+		if neg {
+			f = -f
+		}
+		return f, nil
+	case neg:
+		return nil, p.errorf("expected number")
+	case t.kind == tokString:
+		p.next()
+		return t.text, nil
+	case t.kind == tokKeyword && (t.text == "TRUE" || t.text == "FALSE"):
+		p.next()
+		return t.text == "TRUE", nil
+	}
+	return nil, p.errorf("expected value")
+}
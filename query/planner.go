@@ -0,0 +1,318 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/covrom/cmemdb/db"
+)
+
+// listValues - диапазон по колонке со списками ID, в котором больше значений,
+// собирается в один список ID вместо слияния списков по значениям
+const listValues = 16
+
+// Plan is a node of the WHERE execution plan with the estimated number of rows.
+// Leaf has Cond, And intersects its nodes from the most selective one and subtracts Diffs,
+// Or merges its nodes, All is every row of the table.
+type Plan struct {
+	Cond  *Cond
+	And   []*Plan
+	Or    []*Plan
+	Diffs []*Plan
+	All   bool
+	Est   int
+	List  bool // значения собираются в один список ID
+
+	ct    *db.ColumnType
+	value db.ColumnValue
+	op    db.QueryOptions
+	stats db.ColumnStats
+}
+
+func (p *Plan) String() string {
+	var sb strings.Builder
+	p.write(&sb)
+	return sb.String()
+}
+
+func writePlans(sb *strings.Builder, ps []*Plan, sep string) {
+	sb.WriteString("(")
+	for i, p := range ps {
+		if i > 0 {
+			sb.WriteString(sep)
+		}
+		p.write(sb)
+	}
+	sb.WriteString(")")
+}
+
+func (p *Plan) write(sb *strings.Builder) {
+	switch {
+	case p.Cond != nil:
+		sb.WriteString(p.Cond.Col + " " + opString(p.op) + " " + valueString(p.value))
+		if p.List {
+			sb.WriteString(" list")
+		}
+	case p.All:
+		sb.WriteString("ALL")
+	case p.Or != nil:
+		writePlans(sb, p.Or, " OR ")
+	default:
+		writePlans(sb, p.And, " AND ")
+	}
+	if len(p.Diffs) > 0 {
+		sb.WriteString(" EXCEPT ")
+		writePlans(sb, p.Diffs, " OR ")
+	}
+	sb.WriteString(" [" + strconv.Itoa(p.Est) + "]")
+}
+
+func valueString(v db.ColumnValue) string {
+	switch x := v.(type) {
+	case db.StringValue:
+		return quote(string(x))
+	case db.BytesValue:
+		return quote(string(x))
+	}
+	return fmt.Sprint(v)
+}
+
+type planner struct {
+	dt   *db.DataTable
+	rows int // оценка количества строк таблицы
+}
+
+// Plan builds the execution plan of WHERE, nil without WHERE
+func (q *Query) Plan(dt *db.DataTable) (*Plan, error) {
+	if q.Where == nil {
+		return nil, nil
+	}
+	pl := &planner{dt: dt}
+	for _, ct := range dt.ColumnTypes() {
+		if st, err := dt.Stats(ct.Name); err == nil && st.Rows > pl.rows {
+			pl.rows = st.Rows
+		}
+	}
+	return pl.plan(q.Where)
+}
+
+// selectivity returns the part of the table rows
+func (pl *planner) selectivity(est int) float64 {
+	if pl.rows == 0 {
+		return 0
+	}
+	return float64(est) / float64(pl.rows)
+}
+
+func (pl *planner) plan(e Expr) (*Plan, error) {
+	switch e := e.(type) {
+	case *Cond:
+		return pl.cond(e)
+
+	case Or:
+		p := &Plan{}
+		for _, sub := range e {
+			sp, err := pl.plan(sub)
+			if err != nil {
+				return nil, err
+			}
+			p.Or = append(p.Or, sp)
+			p.Est += sp.Est
+		}
+		if p.Est > pl.rows {
+			p.Est = pl.rows
+		}
+		return p, nil
+
+	case And:
+		return pl.and(e)
+
+	case *Not:
+		return pl.and(And{e})
+	}
+	return &Plan{}, nil
+}
+
+func (pl *planner) cond(c *Cond) (*Plan, error) {
+	ct, err := pl.dt.ColumnType(c.Col)
+	if err != nil {
+		return nil, err
+	}
+	v, err := columnValue(c.Value, ct.ZeroValue)
+	if err != nil {
+		return nil, err
+	}
+	st, err := pl.dt.Stats(c.Col)
+	if err != nil {
+		return nil, err
+	}
+	p := &Plan{
+		Cond:  c,
+		ct:    ct,
+		value: v,
+		op:    c.Op,
+		stats: st,
+	}
+	if c.Op == db.SELECT_NEQ && v != ct.ZeroValue && pl.dt.Estimate(ct.Index, v, 0) == 0 {
+		// значения нет - подходят все непустые
+		p.value = ct.ZeroValue
+	}
+	p.Est = pl.dt.Estimate(ct.Index, p.value, p.op)
+	if c.Op.IsRange() && st.Bits == 0 && st.Rows > 0 {
+		// оценка количества значений в диапазоне
+		p.List = st.Distinct*p.Est/st.Rows > listValues
+	}
+	return p, nil
+}
+
+func (pl *planner) and(e And) (*Plan, error) {
+	p := &Plan{}
+	for _, sub := range e {
+		if not, ok := sub.(*Not); ok {
+			sp, err := pl.plan(not.Expr)
+			if err != nil {
+				return nil, err
+			}
+			p.Diffs = append(p.Diffs, sp)
+			continue
+		}
+		sp, err := pl.plan(sub)
+		if err != nil {
+			return nil, err
+		}
+		p.And = append(p.And, sp)
+	}
+	if len(p.And) == 0 {
+		p.And = append(p.And, &Plan{All: true, Est: pl.rows})
+	}
+	sort.SliceStable(p.And, func(i, j int) bool { return p.And[i].Est < p.And[j].Est })
+	pl.pushNEQ(p)
+
+	// условия считаем независимыми
+	sel := 1.0
+	for _, sp := range p.And {
+		sel *= pl.selectivity(sp.Est)
+	}
+	for _, sp := range p.Diffs {
+		if s := 1 - pl.selectivity(sp.Est); s > 0 {
+			sel *= s
+		} else {
+			sel = 0
+		}
+	}
+	p.Est = int(sel*float64(pl.rows) + 0.5)
+	if p.Est > p.And[0].Est {
+		p.Est = p.And[0].Est
+	}
+	if len(p.And) == 1 && len(p.Diffs) == 0 {
+		return p.And[0], nil
+	}
+	return p, nil
+}
+
+// pushNEQ replaces `col != v` in the intersection by subtraction of `col = v`, if it has less rows.
+// It gives the same IDs only for bitmap columns, where any ID in the span of the column has a value:
+// there are no deleted or unwritten IDs and the span of another condition is inside it.
+// Empty values are subtracted too, if NEQ skips them.
+func (pl *planner) pushNEQ(p *Plan) {
+	for i := 0; i < len(p.And); i++ {
+		sp := p.And[i]
+		if sp.Cond == nil || sp.op != db.SELECT_NEQ || sp.stats.Bits == 0 || sp.value == sp.ct.ZeroValue || len(p.And) == 1 {
+			continue
+		}
+		if sp.stats.MinID > sp.stats.MaxID || sp.stats.Rows != int(sp.stats.MaxID-sp.stats.MinID)+1 {
+			// в диапазоне ID колонки есть ID без значений
+			continue
+		}
+		inside := false
+		for _, other := range p.And {
+			if other != sp && other.Cond != nil &&
+				other.stats.MinID >= sp.stats.MinID && other.stats.MaxID <= sp.stats.MaxID {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			continue
+		}
+
+		eq := &Plan{Cond: sp.Cond, ct: sp.ct, value: sp.value, stats: sp.stats}
+		eq.Est = pl.dt.Estimate(sp.ct.Index, sp.value, 0)
+		diffs := []*Plan{eq}
+		if sp.stats.Bits >= 4 {
+			// SELECT_NEQ для 4 и 8 бит пропускает пустые значения
+			empty := &Plan{Cond: sp.Cond, ct: sp.ct, value: sp.ct.ZeroValue, stats: sp.stats}
+			empty.Est = sp.stats.Empty
+			diffs = append(diffs, empty)
+		}
+		cost := 0
+		for _, d := range diffs {
+			cost += d.Est
+		}
+		if cost >= sp.Est {
+			continue
+		}
+		p.Diffs = append(p.Diffs, diffs...)
+		p.And = append(p.And[:i], p.And[i+1:]...)
+		i--
+	}
+}
+
+// build returns the iterator of the plan, nil if there are no rows
+func (pl *planner) build(p *Plan) db.IDIterator {
+	switch {
+	case p.Cond != nil:
+		iter := pl.dt.Select(p.ct.Index, p.value, p.op)
+		if p.List && iter != nil {
+			var ids []db.IDEntry
+			for iter.HasNext() {
+				ids = append(ids, iter.NextID())
+			}
+			iter = db.NewIteratorByIds(ids, false)
+		}
+		return iter
+
+	case p.All:
+		return allRows(pl.dt)
+
+	case p.Or != nil:
+		var iters []db.IDIterator
+		for _, sp := range p.Or {
+			if it := pl.build(sp); it != nil {
+				iters = append(iters, it)
+			}
+		}
+		return or(pl.dt, iters)
+	}
+
+	// по статистике пересечение пустое - остальные условия не выбираем,
+	// пустое значение может быть и у ID без значения в биткарте, их нет в статистике
+	if first := p.And[0]; first.Est == 0 && first.Cond != nil && first.op != db.SELECT_NEQ && first.value != first.ct.ZeroValue {
+		return nil
+	}
+	iters := make([]db.IDIterator, len(p.And))
+	for i, sp := range p.And {
+		if iters[i] = pl.build(sp); iters[i] == nil {
+			return nil
+		}
+	}
+	var iter db.IDIterator
+	if len(iters) == 1 {
+		iter = iters[0]
+	} else {
+		iter = pl.dt.And(iters...)
+	}
+
+	var diffs []db.IDIterator
+	for _, sp := range p.Diffs {
+		if it := pl.build(sp); it != nil {
+			diffs = append(diffs, it)
+		}
+	}
+	if len(diffs) == 0 {
+		return iter
+	}
+	return pl.dt.Sub(iter, diffs...)
+}
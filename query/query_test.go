@@ -0,0 +1,198 @@
+package query
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/covrom/cmemdb/db"
+)
+
+func testTable() *db.DataTable {
+	dt := &db.DataTable{}
+	dt.AddColumn(&db.ColumnType{Name: "a", ZeroValue: db.IntValue(0), Lines: 100, UniqueValues: 4})
+	dt.AddColumn(&db.ColumnType{Name: "b", ZeroValue: db.StringValue(""), Lines: 100, UniqueValues: 100})
+	dt.AddColumn(&db.ColumnType{Name: "c", ZeroValue: db.IntValue(0), Lines: 100, UniqueValues: 100})
+	dt.AddColumn(&db.ColumnType{Name: "d", ZeroValue: db.FloatValue(0), Lines: 100, UniqueValues: 100})
+	for i := 1; i <= 20; i++ {
+		dt.InsertRow(map[string]db.ColumnValue{
+			"a": db.IntValue(i%3 + 1),
+			"b": db.StringValue(fmt.Sprint("x", i%4)),
+			"c": db.IntValue(i),
+			"d": db.FloatValue(float64(100 - i)),
+		}, 0)
+	}
+	return dt
+}
+
+func queryIDs(t *testing.T, ts Tables, q string) string {
+	t.Helper()
+	rows, err := ts.Query(q)
+	if err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+	var ids []db.IDEntry
+	for rows.Next() {
+		ids = append(ids, rows.ID())
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestParse(t *testing.T) {
+	q, err := Parse(`select a, "b" FROM t WHERE a = 1 AND (b = 'it''s' OR c != -3) and not d >= 2.5 ORDER BY d DESC LIMIT 10 OFFSET 5`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(q.Columns) != "[a b]" || q.Table != "t" || q.OrderBy != "d" || !q.Desc || q.Limit != 10 || q.Offset != 5 {
+		t.Errorf("query: %+v", q)
+	}
+	if s := q.Where.String(); s != "(a = 1 AND (b = 'it''s' OR c != -3) AND NOT d >= 2.5)" {
+		t.Errorf("where: %s", s)
+	}
+
+	for _, s := range []string{
+		"SELECT FROM t",
+		"SELECT * FROM t WHERE a",
+		"SELECT * FROM t WHERE (a = 1",
+		"SELECT * FROM t WHERE a = 'x",
+		"SELECT * FROM t LIMIT -1",
+		"SELECT * FROM t ORDER d",
+		"SELECT * FROM t WHERE a ! 1",
+		"SELECT * FROM t extra",
+	} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%s: no error", s)
+		} else if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ts := Tables{"t": testTable()}
+
+	for q, want := range map[string]string{
+		"SELECT * FROM t WHERE a = 1":                                  "[3 6 9 12 15 18]",
+		"SELECT * FROM t WHERE a = 1 AND (b = 'x2' OR c > 14)":         "[6 15 18]",
+		"SELECT * FROM t WHERE a = 1 AND NOT b = 'x2'":                 "[3 9 12 15]",
+		"SELECT * FROM t WHERE NOT c < 18":                             "[18 19 20]",
+		"SELECT * FROM t WHERE c != 30 AND c <= 3":                     "[1 2 3]",
+		"SELECT * FROM t WHERE a = 3 AND b = 'none'":                   "[]",
+		"SELECT * FROM t WHERE d >= 95.5 OR c = 20":                    "[1 2 3 4 20]",
+		"SELECT c FROM t WHERE a = 2 ORDER BY d LIMIT 3":               "[19 16 13]",
+		"SELECT c FROM t WHERE a = 2 ORDER BY c DESC LIMIT 2 OFFSET 1": "[16 13]",
+		"SELECT c FROM t WHERE b = 'x1' LIMIT 2 OFFSET 1":              "[5 9]",
+		"SELECT * FROM t LIMIT 3":                                      "[1 2 3]",
+	} {
+		if got := queryIDs(t, ts, q); got != want {
+			t.Errorf("%s: got %s, want %s", q, got, want)
+		}
+	}
+
+	rows, err := ts.Query("SELECT b, c FROM t WHERE c = 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() || fmt.Sprint(rows.Values()) != "[x3 7]" {
+		t.Errorf("projection: %v", rows.Values())
+	}
+
+	q, err := Parse("SELECT * FROM t WHERE b = 'x1'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, err := q.Filter(ts["t"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lim := &limitIterator{IDIterator: iter, limit: 2, offset: 1}
+	if n, est := lim.ExactCount(), lim.EstimatedCardinality(); n != 2 || est != 2 {
+		t.Errorf("limit: count %d, estimate %d", n, est)
+	}
+	if lim.HasNext(); lim.ExactCount() != 1 {
+		t.Errorf("limit: count %d after one ID", lim.ExactCount())
+	}
+
+	for q, want := range map[string]error{
+		"SELECT * FROM none":            ErrTableNotFound,
+		"SELECT z FROM t":               db.ErrColumnNotFound,
+		"SELECT * FROM t WHERE z = 1":   db.ErrColumnNotFound,
+		"SELECT * FROM t WHERE a = 'x'": ErrLiteralType,
+		"SELECT * FROM t ORDER BY z":    db.ErrColumnNotFound,
+	} {
+		if _, err := ts.Query(q); err != want {
+			t.Errorf("%s: %v, want %v", q, err, want)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dt := &db.DataTable{}
+	dt.AddColumn(&db.ColumnType{Name: "flag", ZeroValue: db.IntValue(0), Lines: 1000, UniqueValues: 4})
+	dt.AddColumn(&db.ColumnType{Name: "kind", ZeroValue: db.IntValue(0), Lines: 1000, UniqueValues: 16})
+	dt.AddColumn(&db.ColumnType{Name: "n", ZeroValue: db.IntValue(0), Lines: 1000, UniqueValues: 1000})
+	for i := 1; i <= 1000; i++ {
+		flag := 1
+		if i%100 == 0 {
+			flag = 2
+		}
+		dt.InsertRow(map[string]db.ColumnValue{
+			"flag": db.IntValue(flag),
+			"kind": db.IntValue(i%10 + 1),
+			"n":    db.IntValue(i),
+		}, 0)
+	}
+	ts := Tables{"t": dt}
+
+	for q, want := range map[string]string{
+		// редкое значение биткарты первым, хотя все биткарты одной длины
+		"SELECT * FROM t WHERE kind = 1 AND flag = 2": "(flag = 2 [10] AND kind = 1 [100]) [1]",
+		// != с редким результатом остается в пересечении
+		"SELECT * FROM t WHERE kind = 3 AND flag != 1": "(flag != 1 [10] AND kind = 3 [100]) [1]",
+		// != с частым результатом заменяется вычитанием
+		"SELECT * FROM t WHERE kind = 3 AND flag != 2": "(kind = 3 [100]) EXCEPT (flag = 2 [10]) [99]",
+		"SELECT * FROM t WHERE kind = 4 AND kind != 5": "(kind = 4 [100]) EXCEPT (kind = 5 [100] OR kind = 0 [0]) [90]",
+		"SELECT * FROM t WHERE n > 900":                "n > 900 list [100]",
+		"SELECT * FROM t WHERE n > 998 OR n = 5":       "(n > 998 [2] OR n = 5 [1]) [3]",
+	} {
+		pq, err := Parse(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := pq.Plan(dt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.String() != want {
+			t.Errorf("%s: plan %s, want %s", q, p, want)
+		}
+	}
+
+	for q, want := range map[string]string{
+		"SELECT * FROM t WHERE kind = 1 AND flag = 2":              "[100 200 300 400 500 600 700 800 900 1000]",
+		"SELECT * FROM t WHERE kind = 3 AND flag != 2 AND n < 60":  "[2 12 22 32 42 52]",
+		"SELECT * FROM t WHERE kind = 1 AND flag != 1":             "[100 200 300 400 500 600 700 800 900 1000]",
+		"SELECT * FROM t WHERE kind = 4 AND kind != 5 AND n <= 23": "[3 13 23]",
+		"SELECT * FROM t WHERE n > 995 AND NOT flag = 2":           "[996 997 998 999]",
+		"SELECT * FROM t WHERE flag = 2 AND kind = 2 AND n = 1":    "[]",
+	} {
+		if got := queryIDs(t, ts, q); got != want {
+			t.Errorf("%s: got %s, want %s", q, got, want)
+		}
+	}
+
+	// у ID 2 нет значения flag, != не заменяется вычитанием
+	gaps := &db.DataTable{}
+	gaps.AddColumn(&db.ColumnType{Name: "flag", ZeroValue: db.IntValue(0), Lines: 10, UniqueValues: 4})
+	gaps.AddColumn(&db.ColumnType{Name: "kind", ZeroValue: db.IntValue(0), Lines: 10, UniqueValues: 4})
+	for i, flag := range []int{1, 0, 1, 2, 1} {
+		row := map[string]db.ColumnValue{"kind": db.IntValue(1)}
+		if i != 1 {
+			row["flag"] = db.IntValue(flag)
+		}
+		gaps.InsertRow(row, 0)
+	}
+	q := "SELECT * FROM t WHERE kind = 1 AND flag != 2"
+	if got := queryIDs(t, Tables{"t": gaps}, q); got != "[1 3 5]" {
+		t.Errorf("%s with unwritten ID: got %s", q, got)
+	}
+}